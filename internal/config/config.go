@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	dq "github.com/usace/goquery"
 )
@@ -21,6 +23,23 @@ type AppConfig struct {
 	Debug                 bool
 	AwsBucket             string
 	AwsPrefix             string
+	FileStoreType         string
+	FileStorePath         string
+	ExportPrefix          string
+	ExportRetention       time.Duration
+	ExportMaxFeatures     int64
+	ExportMaxMB           int64
+	StatsAsyncFeatures    int
+	UploadMaxMB           int64
+	UploadMaxVertices     int
+	LookupMaxIds          int
+	PresignDownloads      bool
+	PresignExpiration     time.Duration
+	WebhookSecret         string
+	WebhookMaxAttempts    int
+	WebhookBackoff        time.Duration
+	AuthSecret            string
+	VerticalDatumGrids    map[string]string
 	DefaultDatasetName    string
 	DefaultDatasetVersion string
 	DefaultDatasetQuality string
@@ -30,6 +49,73 @@ func GetConfig() AppConfig {
 	appConfig := AppConfig{}
 	appConfig.AwsBucket = os.Getenv("AWS_BUCKET")
 	appConfig.AwsPrefix = os.Getenv("AWS_PREFIX")
+	appConfig.FileStoreType = os.Getenv("FILESTORE")
+	if appConfig.FileStoreType == "" {
+		appConfig.FileStoreType = "s3"
+	}
+	appConfig.FileStorePath = os.Getenv("FILESTORE_PATH")
+	appConfig.ExportPrefix = os.Getenv("EXPORT_PREFIX")
+	if appConfig.ExportPrefix == "" {
+		appConfig.ExportPrefix = "exports/"
+	}
+	retentionHours, err := strconv.Atoi(os.Getenv("EXPORT_RETENTION"))
+	if err != nil || retentionHours == 0 {
+		retentionHours = 24
+	}
+	appConfig.ExportRetention = time.Duration(retentionHours) * time.Hour
+	// zero disables the export limits
+	appConfig.ExportMaxFeatures, _ = strconv.ParseInt(os.Getenv("EXPORT_MAX_FEATURES"), 10, 64)
+	appConfig.ExportMaxMB, _ = strconv.ParseInt(os.Getenv("EXPORT_MAX_MB"), 10, 64)
+	statsAsyncFeatures, err := strconv.Atoi(os.Getenv("STATS_ASYNC_FEATURES"))
+	if err != nil || statsAsyncFeatures == 0 {
+		statsAsyncFeatures = 100
+	}
+	appConfig.StatsAsyncFeatures = statsAsyncFeatures
+	uploadMaxMB, err := strconv.ParseInt(os.Getenv("UPLOAD_MAX_MB"), 10, 64)
+	if err != nil || uploadMaxMB == 0 {
+		uploadMaxMB = 100
+	}
+	appConfig.UploadMaxMB = uploadMaxMB
+	uploadMaxVertices, err := strconv.Atoi(os.Getenv("UPLOAD_MAX_VERTICES"))
+	if err != nil || uploadMaxVertices == 0 {
+		uploadMaxVertices = 1000000
+	}
+	appConfig.UploadMaxVertices = uploadMaxVertices
+	lookupMaxIds, err := strconv.Atoi(os.Getenv("LOOKUP_MAX_IDS"))
+	if err != nil || lookupMaxIds == 0 {
+		lookupMaxIds = 100000
+	}
+	appConfig.LookupMaxIds = lookupMaxIds
+	if os.Getenv("PRESIGN_DOWNLOADS") == "TRUE" {
+		appConfig.PresignDownloads = true
+	}
+	presignMinutes, err := strconv.Atoi(os.Getenv("PRESIGN_EXPIRATION"))
+	if err != nil || presignMinutes == 0 {
+		presignMinutes = 15
+	}
+	appConfig.PresignExpiration = time.Duration(presignMinutes) * time.Minute
+	appConfig.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	webhookAttempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	if err != nil || webhookAttempts == 0 {
+		webhookAttempts = 5
+	}
+	appConfig.WebhookMaxAttempts = webhookAttempts
+	webhookBackoff, err := strconv.Atoi(os.Getenv("WEBHOOK_BACKOFF"))
+	if err != nil || webhookBackoff == 0 {
+		webhookBackoff = 2
+	}
+	appConfig.WebhookBackoff = time.Duration(webhookBackoff) * time.Second
+	// key of the HS256 tokens identifying users; without it requests needing
+	// a user are refused
+	appConfig.AuthSecret = os.Getenv("AUTH_SECRET")
+	// NAME=path pairs of local geoid grids, comma separated
+	appConfig.VerticalDatumGrids = map[string]string{}
+	for _, datum := range strings.Split(os.Getenv("VERTICAL_DATUM_GRIDS"), ",") {
+		parts := strings.SplitN(datum, "=", 2)
+		if len(parts) == 2 {
+			appConfig.VerticalDatumGrids[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
 	appConfig.Dbuser = os.Getenv("DBUSER")
 	appConfig.Dbpass = os.Getenv("DBPASS")
 	appConfig.Dbhost = os.Getenv("DBHOST")
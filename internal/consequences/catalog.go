@@ -0,0 +1,243 @@
+package consequences
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+)
+
+// FunctionSetDocument is the JSON form of a catalog function set
+type FunctionSetDocument struct {
+	Id          string                `json:"id,omitempty"`
+	Name        string                `json:"name"`
+	Version     string                `json:"version"`
+	Description string                `json:"description"`
+	Functions   []DepthDamageFunction `json:"functions"`
+}
+
+// Validate checks the set has a name and version and that every function
+// is valid with a distinct occupancy type
+func (doc *FunctionSetDocument) Validate() error {
+	if doc.Name == "" || doc.Version == "" {
+		return errors.New("function set name and version are required")
+	}
+	if len(doc.Functions) == 0 {
+		return errors.New("function set has no functions")
+	}
+	occtypes := make(map[string]bool)
+	for i := range doc.Functions {
+		f := &doc.Functions[i]
+		f.Occtype = strings.ToUpper(strings.TrimSpace(f.Occtype))
+		if occtypes[f.Occtype] {
+			return fmt.Errorf("duplicate function for occtype %s", f.Occtype)
+		}
+		occtypes[f.Occtype] = true
+		err := f.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks the function has an occupancy type, increasing depths and
+// percent damages between 0 and 100 with non negative uncertainty
+func (f DepthDamageFunction) Validate() error {
+	if f.Occtype == "" {
+		return errors.New("function occtype is required")
+	}
+	n := len(f.Depths)
+	if n == 0 {
+		return fmt.Errorf("function %s has no depths", f.Occtype)
+	}
+	if len(f.Structure) != n || len(f.Contents) != n ||
+		(f.StructureSd != nil && len(f.StructureSd) != n) ||
+		(f.ContentsSd != nil && len(f.ContentsSd) != n) {
+		return fmt.Errorf("function %s must have a value for every depth", f.Occtype)
+	}
+	for i := 0; i < n; i++ {
+		if i > 0 && f.Depths[i] <= f.Depths[i-1] {
+			return fmt.Errorf("function %s depths must be increasing", f.Occtype)
+		}
+		if !isPercent(f.Structure[i]) || !isPercent(f.Contents[i]) {
+			return fmt.Errorf("function %s damage must be between 0 and 100 percent", f.Occtype)
+		}
+		if (f.StructureSd != nil && f.StructureSd[i] < 0) || (f.ContentsSd != nil && f.ContentsSd[i] < 0) {
+			return fmt.Errorf("function %s standard deviations must not be negative", f.Occtype)
+		}
+	}
+	return nil
+}
+
+func isPercent(v float64) bool {
+	return v >= 0 && v <= 100
+}
+
+// csvColumns are the columns of the function set csv format, with one row
+// per depth of each function
+var csvColumns = []string{"occtype", "name", "depth", "structure", "structure_sd", "contents", "contents_sd"}
+
+// ReadFunctionsCsv reads functions from csv with a header row.  The name and
+// standard deviation columns are optional.
+func ReadFunctionsCsv(r io.Reader) ([]DepthDamageFunction, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read csv header: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"occtype", "depth", "structure", "contents"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv is missing the %s column", required)
+		}
+	}
+	functions := []DepthDamageFunction{}
+	index := make(map[string]int)
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("unable to read csv line %d: %s", line, err)
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(column string) (float64, error) {
+			v := value(column)
+			if v == "" {
+				return 0, nil
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s on csv line %d: %s", column, line, v)
+			}
+			return n, nil
+		}
+		occtype := strings.ToUpper(value("occtype"))
+		i, ok := index[occtype]
+		if !ok {
+			i = len(functions)
+			index[occtype] = i
+			functions = append(functions, DepthDamageFunction{Occtype: occtype, Name: value("name")})
+		}
+		f := &functions[i]
+		values := make([]float64, len(csvColumns)-2)
+		for c, column := range csvColumns[2:] {
+			values[c], err = number(column)
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.Depths = append(f.Depths, values[0])
+		f.Structure = append(f.Structure, values[1])
+		f.StructureSd = append(f.StructureSd, values[2])
+		f.Contents = append(f.Contents, values[3])
+		f.ContentsSd = append(f.ContentsSd, values[4])
+	}
+	return functions, nil
+}
+
+// WriteFunctionsCsv writes functions in the csv format read by ReadFunctionsCsv
+func WriteFunctionsCsv(w io.Writer, functions []DepthDamageFunction) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(csvColumns)
+	if err != nil {
+		return err
+	}
+	for _, f := range functions {
+		for i, depth := range f.Depths {
+			err = writer.Write([]string{
+				f.Occtype,
+				f.Name,
+				formatFloat(depth),
+				formatFloat(f.Structure[i]),
+				formatFloat(valueAt(f.StructureSd, i)),
+				formatFloat(f.Contents[i]),
+				formatFloat(valueAt(f.ContentsSd, i)),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func valueAt(values []float64, i int) float64 {
+	if i < len(values) {
+		return values[i]
+	}
+	return 0
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// FunctionFromModel converts a catalog function.  Uncertainty is omitted
+// when the catalog has none for the function.
+func FunctionFromModel(ddf models.Ddf) DepthDamageFunction {
+	f := DepthDamageFunction{Occtype: ddf.Occtype, Name: ddf.Name}
+	hasSd := false
+	for _, v := range ddf.Values {
+		f.Depths = append(f.Depths, v.Depth)
+		f.Structure = append(f.Structure, v.Structure)
+		f.StructureSd = append(f.StructureSd, v.StructureSd)
+		f.Contents = append(f.Contents, v.Contents)
+		f.ContentsSd = append(f.ContentsSd, v.ContentsSd)
+		hasSd = hasSd || v.StructureSd != 0 || v.ContentsSd != 0
+	}
+	if !hasSd {
+		f.StructureSd = nil
+		f.ContentsSd = nil
+	}
+	if f.Name == "" {
+		f.Name = f.Occtype
+	}
+	return f
+}
+
+// Model converts a function to its catalog form
+func (f DepthDamageFunction) Model() models.Ddf {
+	ddf := models.Ddf{Occtype: f.Occtype, Name: f.Name}
+	for i, depth := range f.Depths {
+		ddf.Values = append(ddf.Values, models.DdfValue{
+			Depth:       depth,
+			Structure:   f.Structure[i],
+			StructureSd: valueAt(f.StructureSd, i),
+			Contents:    f.Contents[i],
+			ContentsSd:  valueAt(f.ContentsSd, i),
+		})
+	}
+	return ddf
+}
+
+// WithCatalog returns a copy of the function set with the catalog functions
+// added, replacing functions for the same occupancy types
+func (fs FunctionSet) WithCatalog(ddfs []models.Ddf) FunctionSet {
+	functions := make(FunctionSet, len(fs)+len(ddfs))
+	for occtype, f := range fs {
+		functions[occtype] = f
+	}
+	for _, ddf := range ddfs {
+		functions[strings.ToUpper(ddf.Occtype)] = FunctionFromModel(ddf)
+	}
+	return functions
+}
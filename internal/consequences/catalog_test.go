@@ -0,0 +1,139 @@
+package consequences
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFunctionsCsvRoundTrip(t *testing.T) {
+	functions := []DepthDamageFunction{
+		{
+			Occtype:     "RES1-1SNB",
+			Name:        "one story, no basement",
+			Depths:      []float64{-1, 0, 2.5},
+			Structure:   []float64{0, 13.4, 32.1},
+			StructureSd: []float64{0, 2, 3.25},
+			Contents:    []float64{0, 8.1, 17.9},
+			ContentsSd:  []float64{0, 1, 1.5},
+		},
+		{
+			Occtype:     "COM1",
+			Name:        "retail",
+			Depths:      []float64{0, 4},
+			Structure:   []float64{5, 40},
+			StructureSd: []float64{0, 0},
+			Contents:    []float64{10, 80},
+			ContentsSd:  []float64{0, 0},
+		},
+	}
+	var buf bytes.Buffer
+	if err := WriteFunctionsCsv(&buf, functions); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFunctionsCsv(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, functions) {
+		t.Errorf("round trip = %+v, want %+v", got, functions)
+	}
+}
+
+func TestReadFunctionsCsv(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []DepthDamageFunction
+		wantErr string
+	}{
+		{
+			name: "optional columns",
+			csv:  "OccType, Depth, Structure, Contents\nres2,0,0,0\nres2,1,10,12\n",
+			want: []DepthDamageFunction{{
+				Occtype:     "RES2",
+				Depths:      []float64{0, 1},
+				Structure:   []float64{0, 10},
+				StructureSd: []float64{0, 0},
+				Contents:    []float64{0, 12},
+				ContentsSd:  []float64{0, 0},
+			}},
+		},
+		{name: "missing column", csv: "occtype,depth,structure\nRES2,0,0\n", wantErr: "missing the contents column"},
+		{name: "invalid number", csv: "occtype,depth,structure,contents\nRES2,0,x,0\n", wantErr: "invalid structure on csv line 2"},
+		{name: "empty", csv: "", wantErr: "unable to read csv header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadFunctionsCsv(strings.NewReader(tt.csv))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ReadFunctionsCsv() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadFunctionsCsv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionSetDocumentValidate(t *testing.T) {
+	valid := func() DepthDamageFunction {
+		return DepthDamageFunction{Occtype: " res1 ", Depths: []float64{0, 1}, Structure: []float64{0, 50}, Contents: []float64{0, 25}}
+	}
+	with := func(change func(f *DepthDamageFunction)) DepthDamageFunction {
+		f := valid()
+		change(&f)
+		return f
+	}
+	tests := []struct {
+		name      string
+		doc       FunctionSetDocument
+		wantErr   string
+		wantFirst string
+	}{
+		{name: "valid", doc: FunctionSetDocument{Name: "a", Version: "1", Functions: []DepthDamageFunction{valid()}}, wantFirst: "RES1"},
+		{name: "no name", doc: FunctionSetDocument{Version: "1", Functions: []DepthDamageFunction{valid()}}, wantErr: "name and version"},
+		{name: "no version", doc: FunctionSetDocument{Name: "a", Functions: []DepthDamageFunction{valid()}}, wantErr: "name and version"},
+		{name: "no functions", doc: FunctionSetDocument{Name: "a", Version: "1"}, wantErr: "no functions"},
+		{name: "duplicate occtype", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{valid(), with(func(f *DepthDamageFunction) { f.Occtype = "RES1" })}}, wantErr: "duplicate function for occtype RES1"},
+		{name: "no occtype", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.Occtype = "" })}}, wantErr: "occtype is required"},
+		{name: "no depths", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.Depths, f.Structure, f.Contents = nil, nil, nil })}}, wantErr: "has no depths"},
+		{name: "missing values", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.Contents = []float64{0} })}}, wantErr: "value for every depth"},
+		{name: "missing sd values", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.StructureSd = []float64{1} })}}, wantErr: "value for every depth"},
+		{name: "decreasing depths", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.Depths = []float64{1, 1} })}}, wantErr: "increasing"},
+		{name: "damage over 100", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.Structure = []float64{0, 101} })}}, wantErr: "between 0 and 100"},
+		{name: "negative sd", doc: FunctionSetDocument{Name: "a", Version: "1",
+			Functions: []DepthDamageFunction{with(func(f *DepthDamageFunction) { f.ContentsSd = []float64{0, -1} })}}, wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.doc.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.doc.Functions[0].Occtype != tt.wantFirst {
+				t.Errorf("occtype = %q, want %q", tt.doc.Functions[0].Occtype, tt.wantFirst)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package consequences
+
+import (
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+const metersToFeet = 3.28084
+
+// Sampler returns the hazard value at an EPSG:4326 coordinate
+type Sampler interface {
+	Sample(lon float64, lat float64) (float64, bool)
+}
+
+// Result is the estimated damage to a single structure.  Structures whose
+// occupancy type has no function are NoFunction and have no damage.
+type Result struct {
+	Depth             float64 // feet above ground
+	FloorDepth        float64 // feet above the first floor
+	Function          string
+	NoFunction        bool
+	StructureDamage   float64
+	StructureDamageSd float64
+	ContentDamage     float64
+	ContentDamageSd   float64
+}
+
+type Total struct {
+	Structures      int     `json:"structures"`
+	Flooded         int     `json:"flooded"`
+	NoFunction      int     `json:"no_function"`
+	StructureDamage float64 `json:"structure_damage"`
+	ContentDamage   float64 `json:"content_damage"`
+}
+
+func (t *Total) add(r Result) {
+	t.Structures++
+	if r.Depth > 0 {
+		t.Flooded++
+	}
+	if r.NoFunction {
+		t.NoFunction++
+	}
+	t.StructureDamage += r.StructureDamage
+	t.ContentDamage += r.ContentDamage
+}
+
+// Totals aggregates results by damage category and by fips code
+type Totals struct {
+	Total    Total             `json:"total"`
+	ByDamcat map[string]*Total `json:"by_damcat"`
+	ByFips   map[string]*Total `json:"by_fips"`
+}
+
+// Estimator computes structure damage from a depth or water surface
+// elevation grid
+type Estimator struct {
+	Hazard       Sampler
+	Functions    FunctionSet
+	WaterSurface bool // the hazard is a water surface elevation rather than a depth
+	Meters       bool // the hazard values are in meters
+	FipsLength   int  // length of the fips codes totals are grouped by
+	Totals       Totals
+}
+
+func NewEstimator(hazard Sampler, functions FunctionSet, waterSurface bool, meters bool, fipsLength int) *Estimator {
+	return &Estimator{
+		Hazard:       hazard,
+		Functions:    functions,
+		WaterSurface: waterSurface,
+		Meters:       meters,
+		FipsLength:   fipsLength,
+		Totals: Totals{
+			ByDamcat: map[string]*Total{},
+			ByFips:   map[string]*Total{},
+		},
+	}
+}
+
+// Estimate samples the hazard at the structure and applies the depth damage
+// function for its occupancy type.  Damage standard deviations are in dollars
+// when the function has uncertainty.  Structures outside the hazard are not
+// ok.
+func (e *Estimator) Estimate(nsi *stores.Nsi) (Result, bool) {
+	value, ok := e.Hazard.Sample(nsi.X, nsi.Y)
+	if !ok {
+		return Result{}, false
+	}
+	if e.Meters {
+		value *= metersToFeet
+	}
+	r := Result{Depth: value}
+	if e.WaterSurface {
+		r.Depth = value - nsi.Ground_elv
+	}
+	r.FloorDepth = r.Depth - nsi.Found_ht
+	f, ok := e.Functions.FunctionFor(nsi.Occtype)
+	if !ok {
+		r.NoFunction = true
+	} else {
+		r.Function = f.Name
+		if r.Depth > 0 {
+			structurePct, contentPct := f.Damage(r.FloorDepth)
+			structureSd, contentSd := f.DamageSd(r.FloorDepth)
+			r.StructureDamage = nsi.Val_struct * structurePct / 100
+			r.StructureDamageSd = nsi.Val_struct * structureSd / 100
+			r.ContentDamage = nsi.Val_cont * contentPct / 100
+			r.ContentDamageSd = nsi.Val_cont * contentSd / 100
+		}
+	}
+	e.addTotals(nsi, r)
+	return r, true
+}
+
+func (e *Estimator) addTotals(nsi *stores.Nsi, r Result) {
+	e.Totals.Total.add(r)
+	total(e.Totals.ByDamcat, nsi.St_damcat).add(r)
+	fips := nsi.CbFips
+	if len(fips) > e.FipsLength {
+		fips = fips[:e.FipsLength]
+	}
+	total(e.Totals.ByFips, fips).add(r)
+}
+
+func total(totals map[string]*Total, key string) *Total {
+	t, ok := totals[key]
+	if !ok {
+		t = &Total{}
+		totals[key] = t
+	}
+	return t
+}
@@ -0,0 +1,91 @@
+package consequences
+
+import (
+	"math"
+	"testing"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+// constantSampler returns the same hazard value everywhere east of lon 0
+type constantSampler float64
+
+func (s constantSampler) Sample(lon float64, lat float64) (float64, bool) {
+	return float64(s), lon >= 0
+}
+
+func TestEstimate(t *testing.T) {
+	functions := FunctionSet{
+		"RES1": {
+			Name:        "linear",
+			Depths:      []float64{0, 10},
+			Structure:   []float64{0, 100},
+			StructureSd: []float64{0, 10},
+			Contents:    []float64{0, 50},
+		},
+	}
+	structure := stores.Nsi{X: 1, Y: 1, Occtype: "RES1-1SNB", St_damcat: "RES", CbFips: "010010201001",
+		Found_ht: 1, Ground_elv: 100, Val_struct: 1000, Val_cont: 500}
+	tests := []struct {
+		name         string
+		hazard       float64
+		waterSurface bool
+		meters       bool
+		nsi          stores.Nsi
+		ok           bool
+		want         Result
+	}{
+		{"depth", 3, false, false, structure, true,
+			Result{Depth: 3, FloorDepth: 2, Function: "linear", StructureDamage: 200, StructureDamageSd: 20, ContentDamage: 50}},
+		{"water surface", 104, true, false, structure, true,
+			Result{Depth: 4, FloorDepth: 3, Function: "linear", StructureDamage: 300, StructureDamageSd: 30, ContentDamage: 75}},
+		{"meters", 1, false, true, structure, true,
+			Result{Depth: 3.28084, FloorDepth: 2.28084, Function: "linear", StructureDamage: 228.084, StructureDamageSd: 22.8084, ContentDamage: 57.021}},
+		{"dry", 0, false, false, structure, true,
+			Result{Depth: 0, FloorDepth: -1, Function: "linear"}},
+		{"no function", 3, false, false, stores.Nsi{X: 1, Occtype: "COM1", Val_struct: 1000}, true,
+			Result{Depth: 3, FloorDepth: 3, NoFunction: true}},
+		{"outside the hazard", 3, false, false, stores.Nsi{X: -1, Occtype: "RES1"}, false, Result{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEstimator(constantSampler(tt.hazard), functions, tt.waterSurface, tt.meters, 5)
+			got, ok := e.Estimate(&tt.nsi)
+			if ok != tt.ok || !resultsEqual(got, tt.want) {
+				t.Errorf("Estimate() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEstimateTotals(t *testing.T) {
+	functions := FunctionSet{"RES1": {Name: "all", Depths: []float64{0, 1}, Structure: []float64{100, 100}, Contents: []float64{0, 0}}}
+	e := NewEstimator(constantSampler(2), functions, false, false, 5)
+	structures := []stores.Nsi{
+		{X: 1, Occtype: "RES1-1SNB", St_damcat: "RES", CbFips: "010010201001", Val_struct: 100},
+		{X: 1, Occtype: "RES1-2SNB", St_damcat: "RES", CbFips: "010030101002", Val_struct: 200},
+		{X: 1, Occtype: "COM1", St_damcat: "COM", CbFips: "010010201003", Val_struct: 400},
+		{X: -1, Occtype: "RES1", St_damcat: "RES", CbFips: "010010201001", Val_struct: 800},
+	}
+	for i := range structures {
+		e.Estimate(&structures[i])
+	}
+	want := Total{Structures: 3, Flooded: 3, NoFunction: 1, StructureDamage: 300}
+	if e.Totals.Total != want {
+		t.Errorf("total = %+v, want %+v", e.Totals.Total, want)
+	}
+	if got := *e.Totals.ByDamcat["RES"]; got.Structures != 2 || got.StructureDamage != 300 {
+		t.Errorf("RES total = %+v", got)
+	}
+	if got := *e.Totals.ByFips["01001"]; got.Structures != 2 || got.NoFunction != 1 {
+		t.Errorf("01001 total = %+v", got)
+	}
+}
+
+func resultsEqual(a Result, b Result) bool {
+	near := func(x, y float64) bool { return math.Abs(x-y) < 1e-6 }
+	return near(a.Depth, b.Depth) && near(a.FloorDepth, b.FloorDepth) && a.Function == b.Function &&
+		a.NoFunction == b.NoFunction && near(a.StructureDamage, b.StructureDamage) &&
+		near(a.StructureDamageSd, b.StructureDamageSd) && near(a.ContentDamage, b.ContentDamage) &&
+		near(a.ContentDamageSd, b.ContentDamageSd)
+}
@@ -0,0 +1,150 @@
+package consequences
+
+import (
+	"sort"
+	"strings"
+)
+
+// DepthDamageFunction gives the percent damage to a structure and its
+// contents by depth of flooding in feet above the first floor.  The optional
+// standard deviations describe the uncertainty of the percent damage.
+type DepthDamageFunction struct {
+	Occtype     string    `json:"occtype,omitempty"`
+	Name        string    `json:"name"`
+	Depths      []float64 `json:"depths"`
+	Structure   []float64 `json:"structure"`
+	StructureSd []float64 `json:"structure_sd,omitempty"`
+	Contents    []float64 `json:"contents"`
+	ContentsSd  []float64 `json:"contents_sd,omitempty"`
+}
+
+// Damage interpolates the structure and content percent damage at depth.
+// Depths beyond the ends of the function take the end values.
+func (f DepthDamageFunction) Damage(depth float64) (float64, float64) {
+	return interpolate(f.Depths, f.Structure, depth), interpolate(f.Depths, f.Contents, depth)
+}
+
+// DamageSd interpolates the standard deviations of the structure and content
+// percent damage at depth, which are zero for functions without uncertainty
+func (f DepthDamageFunction) DamageSd(depth float64) (float64, float64) {
+	var structureSd, contentsSd float64
+	if len(f.StructureSd) == len(f.Depths) {
+		structureSd = interpolate(f.Depths, f.StructureSd, depth)
+	}
+	if len(f.ContentsSd) == len(f.Depths) {
+		contentsSd = interpolate(f.Depths, f.ContentsSd, depth)
+	}
+	return structureSd, contentsSd
+}
+
+func interpolate(xs []float64, ys []float64, x float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	if x <= xs[0] {
+		return ys[0]
+	}
+	i := sort.SearchFloat64s(xs, x)
+	if i >= len(xs) {
+		return ys[len(ys)-1]
+	}
+	if xs[i] == x {
+		return ys[i]
+	}
+	f := (x - xs[i-1]) / (xs[i] - xs[i-1])
+	return ys[i-1] + f*(ys[i]-ys[i-1])
+}
+
+// FunctionSet is a set of depth damage functions keyed by occupancy type
+type FunctionSet map[string]DepthDamageFunction
+
+// FunctionFor returns the function for an occupancy type, falling back to
+// the type without its structure suffix (RES1-1SNB to RES1) and then the
+// occupancy class (COM4 to COM).  It is not ok when none of them has a
+// function.
+func (fs FunctionSet) FunctionFor(occtype string) (DepthDamageFunction, bool) {
+	for _, name := range occtypeCandidates(occtype) {
+		if f, ok := fs[name]; ok {
+			return f, true
+		}
+	}
+	return DepthDamageFunction{}, false
+}
+
+// occtypeCandidates are the keys looked up for an occupancy type, from the
+// most to the least specific
+func occtypeCandidates(occtype string) []string {
+	occtype = strings.ToUpper(strings.TrimSpace(occtype))
+	candidates := []string{occtype}
+	if i := strings.Index(occtype, "-"); i > 0 {
+		occtype = occtype[:i]
+		candidates = append(candidates, occtype)
+	}
+	if len(occtype) > 3 {
+		candidates = append(candidates, occtype[:3])
+	}
+	return candidates
+}
+
+var residentialDepths = []float64{-2, -1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+var basementDepths = []float64{-8, -7, -6, -5, -4, -3, -2, -1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+var genericDepths = []float64{-1, 0, 1, 2, 3, 4, 6, 8, 10, 12, 16}
+
+// BuiltinFunctions are generic depth damage functions approximating the
+// USACE single family residential curves and a manufactured housing curve.
+// They are intended for screening level estimates.  Other occupancy types
+// need functions from a catalog.
+var BuiltinFunctions = FunctionSet{
+	"RES1-1SNB": {
+		Name:      "RES1-1SNB",
+		Depths:    residentialDepths,
+		Structure: []float64{0, 2.5, 13.4, 23.3, 32.1, 40.1, 47.1, 53.2, 58.6, 63.2, 67.2, 70.5, 73.2, 75.4, 77.2, 78.5, 79.5, 80.2, 80.7},
+		Contents:  []float64{0, 2.4, 8.1, 13.3, 17.9, 22, 25.7, 28.8, 31.5, 33.8, 35.7, 37.2, 38.4, 39.2, 39.7, 40, 40, 40, 40},
+	},
+	"RES1-2SNB": {
+		Name:      "RES1-2SNB",
+		Depths:    residentialDepths,
+		Structure: []float64{0, 3, 9.3, 15.2, 20.9, 26.3, 31.4, 36.2, 40.7, 44.9, 48.8, 52.4, 55.7, 58.7, 61.4, 63.8, 65.9, 67.7, 69.2},
+		Contents:  []float64{0, 1, 5, 8.7, 12.2, 15.5, 18.5, 21.3, 23.9, 26.3, 28.4, 30.3, 32, 33.4, 34.7, 35.6, 36.4, 36.9, 37.2},
+	},
+	"RES1-1SWB": {
+		Name:      "RES1-1SWB",
+		Depths:    basementDepths,
+		Structure: []float64{0.7, 0.8, 2.4, 5.2, 9, 13.8, 19.4, 25.5, 32, 38.7, 45.5, 52.2, 58.6, 64.5, 69.8, 74.3, 77.7, 80.1, 81.1},
+		Contents:  []float64{0.1, 0.8, 2.1, 3.7, 5.7, 8, 10.5, 13.2, 16, 18.9, 21.8, 24.7, 27.4, 30, 32.4, 34.5, 36.3, 37.7, 38.6},
+	},
+	"RES1-2SWB": {
+		Name:      "RES1-2SWB",
+		Depths:    basementDepths,
+		Structure: []float64{1.7, 1.7, 1.9, 2.9, 4.7, 7.2, 10.2, 13.9, 17.9, 22.3, 27, 31.9, 36.9, 41.9, 46.9, 51.8, 56.4, 60.8, 64.8},
+		Contents:  []float64{0, 1, 2.3, 3.7, 5.2, 6.8, 8.4, 10.1, 11.9, 13.8, 15.7, 17.7, 19.8, 22, 24.3, 26.7, 29.1, 31.7, 34.4},
+	},
+	"RES2": {
+		Name:      "RES2",
+		Depths:    genericDepths,
+		Structure: []float64{0, 10, 44, 63, 73, 78, 80, 81, 81, 81, 81},
+		Contents:  []float64{0, 12, 50, 70, 80, 85, 88, 90, 90, 90, 90},
+	},
+}
+
+func init() {
+	for occtype, f := range BuiltinFunctions {
+		f.Occtype = occtype
+		BuiltinFunctions[occtype] = f
+	}
+	//single family split level and multi-story homes use the two story curves
+	aliasFunction("RES1-SLNB", "RES1-2SNB")
+	aliasFunction("RES1-3SNB", "RES1-2SNB")
+	aliasFunction("RES1-SLWB", "RES1-2SWB")
+	aliasFunction("RES1-3SWB", "RES1-2SWB")
+	aliasFunction("RES1", "RES1-1SNB")
+}
+
+// aliasFunction adds a function for occtype with the curves of another
+// occupancy type, named for occtype so results report the occupancy type
+func aliasFunction(occtype string, curves string) {
+	f := BuiltinFunctions[curves]
+	f.Occtype = occtype
+	f.Name = occtype
+	BuiltinFunctions[occtype] = f
+}
@@ -0,0 +1,89 @@
+package consequences
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	xs := []float64{0, 2, 4}
+	ys := []float64{10, 20, 40}
+	tests := []struct {
+		name string
+		xs   []float64
+		x    float64
+		want float64
+	}{
+		{"below the first depth", xs, -1, 10},
+		{"first depth", xs, 0, 10},
+		{"between depths", xs, 1, 15},
+		{"at a depth", xs, 2, 20},
+		{"between later depths", xs, 3.5, 35},
+		{"last depth", xs, 4, 40},
+		{"beyond the last depth", xs, 9, 40},
+		{"no depths", nil, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interpolate(tt.xs, ys, tt.x); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("interpolate(%v) = %v, want %v", tt.x, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDamageSd(t *testing.T) {
+	f := DepthDamageFunction{
+		Depths:      []float64{0, 2},
+		Structure:   []float64{0, 50},
+		StructureSd: []float64{0, 10},
+		Contents:    []float64{0, 20},
+	}
+	structureSd, contentsSd := f.DamageSd(1)
+	if structureSd != 5 || contentsSd != 0 {
+		t.Errorf("DamageSd(1) = %v, %v, want 5, 0", structureSd, contentsSd)
+	}
+}
+
+func TestFunctionFor(t *testing.T) {
+	fs := FunctionSet{
+		"RES1-1SNB": {Name: "one story"},
+		"RES1":      {Name: "single family"},
+		"COM":       {Name: "commercial"},
+		"IND2":      {Name: "light industrial"},
+	}
+	tests := []struct {
+		occtype string
+		want    string
+		ok      bool
+	}{
+		{"RES1-1SNB", "one story", true},
+		{" res1-1snb ", "one story", true},
+		{"RES1-2SNB", "single family", true},
+		{"RES1", "single family", true},
+		{"COM4", "commercial", true},
+		{"COM10-X", "commercial", true},
+		{"IND2", "light industrial", true},
+		{"IND3", "", false},
+		{"RES2", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.occtype, func(t *testing.T) {
+			f, ok := fs.FunctionFor(tt.occtype)
+			if ok != tt.ok || f.Name != tt.want {
+				t.Errorf("FunctionFor(%q) = %q, %v, want %q, %v", tt.occtype, f.Name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestBuiltinAliases(t *testing.T) {
+	f, ok := BuiltinFunctions.FunctionFor("RES1-SLNB")
+	if !ok || f.Name != "RES1-SLNB" || f.Occtype != "RES1-SLNB" {
+		t.Fatalf("FunctionFor(RES1-SLNB) = %q %q, %v", f.Name, f.Occtype, ok)
+	}
+	if f.Structure[5] != BuiltinFunctions["RES1-2SNB"].Structure[5] {
+		t.Errorf("RES1-SLNB does not use the RES1-2SNB curves")
+	}
+}
@@ -0,0 +1,82 @@
+package consequences
+
+import (
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+// Population is the population at risk in a group of structures.  Night
+// population is the 2am count and day population the 2pm count.  Disabled
+// population weights each age group by its o65disable or u65disable fraction.
+type Population struct {
+	Structures         int     `json:"structures"`
+	DisabledStructures int     `json:"disabled_structures"`
+	NightUnder65       int64   `json:"night_under65"`
+	NightOver65        int64   `json:"night_over65"`
+	DayUnder65         int64   `json:"day_under65"`
+	DayOver65          int64   `json:"day_over65"`
+	Night              int64   `json:"night"`
+	Day                int64   `json:"day"`
+	NightDisabled      float64 `json:"night_disabled"`
+	DayDisabled        float64 `json:"day_disabled"`
+}
+
+func (p *Population) add(nsi *stores.Nsi) {
+	p.Structures++
+	if nsi.O65disable > 0 || nsi.U65disable > 0 {
+		p.DisabledStructures++
+	}
+	p.NightUnder65 += int64(nsi.Pop2amu65)
+	p.NightOver65 += int64(nsi.Pop2amo65)
+	p.DayUnder65 += int64(nsi.Pop2pmu65)
+	p.DayOver65 += int64(nsi.Pop2pmo65)
+	p.Night += int64(nsi.Pop2amu65 + nsi.Pop2amo65)
+	p.Day += int64(nsi.Pop2pmu65 + nsi.Pop2pmo65)
+	p.NightDisabled += NightDisabled(nsi)
+	p.DayDisabled += DayDisabled(nsi)
+}
+
+// NightDisabled is the disability weighted night population of a structure
+func NightDisabled(nsi *stores.Nsi) float64 {
+	return float64(nsi.Pop2amu65)*nsi.U65disable + float64(nsi.Pop2amo65)*nsi.O65disable
+}
+
+// DayDisabled is the disability weighted day population of a structure
+func DayDisabled(nsi *stores.Nsi) float64 {
+	return float64(nsi.Pop2pmu65)*nsi.U65disable + float64(nsi.Pop2pmo65)*nsi.O65disable
+}
+
+// PopulationAtRisk aggregates population by damage category (RES, COM, IND,
+// PUB...) and by occupancy class (occtype without its structure suffix)
+type PopulationAtRisk struct {
+	Total       Population             `json:"total"`
+	ByDamcat    map[string]*Population `json:"by_damcat"`
+	ByOccupancy map[string]*Population `json:"by_occupancy"`
+}
+
+func NewPopulationAtRisk() *PopulationAtRisk {
+	return &PopulationAtRisk{
+		ByDamcat:    map[string]*Population{},
+		ByOccupancy: map[string]*Population{},
+	}
+}
+
+func (par *PopulationAtRisk) Add(nsi *stores.Nsi) {
+	par.Total.add(nsi)
+	population(par.ByDamcat, nsi.St_damcat).add(nsi)
+	occupancy := nsi.Occtype
+	if i := strings.Index(occupancy, "-"); i > 0 {
+		occupancy = occupancy[:i]
+	}
+	population(par.ByOccupancy, occupancy).add(nsi)
+}
+
+func population(groups map[string]*Population, key string) *Population {
+	p, ok := groups[key]
+	if !ok {
+		p = &Population{}
+		groups[key] = p
+	}
+	return p
+}
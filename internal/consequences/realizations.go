@@ -0,0 +1,161 @@
+package consequences
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+// Distribution describes the uncertainty of a structure attribute relative
+// to its inventory value.  Normal adds a draw with standard deviation Sd in
+// the attribute units.  Lognormal, triangular and uniform scale the value by
+// a draw: exp(N(0,Sd)), Tri(Min,Mode,Max) and U(Min,Max).
+type Distribution struct {
+	Type string  `json:"type"`
+	Sd   float64 `json:"sd,omitempty"`
+	Min  float64 `json:"min,omitempty"`
+	Mode float64 `json:"mode,omitempty"`
+	Max  float64 `json:"max,omitempty"`
+}
+
+func (d Distribution) Validate() error {
+	switch d.Type {
+	case "normal", "lognormal":
+		if d.Sd < 0 {
+			return fmt.Errorf("%s sd must not be negative", d.Type)
+		}
+	case "triangular":
+		if d.Min < 0 || d.Min > d.Mode || d.Mode > d.Max {
+			return fmt.Errorf("triangular must have 0 <= min <= mode <= max")
+		}
+	case "uniform":
+		if d.Min < 0 || d.Min > d.Max {
+			return fmt.Errorf("uniform must have 0 <= min <= max")
+		}
+	case "none":
+	default:
+		return fmt.Errorf("invalid distribution type: %s", d.Type)
+	}
+	return nil
+}
+
+// Sample draws a realization of value
+func (d Distribution) Sample(r *rand.Rand, value float64) float64 {
+	switch d.Type {
+	case "normal":
+		return value + r.NormFloat64()*d.Sd
+	case "lognormal":
+		return value * math.Exp(r.NormFloat64()*d.Sd)
+	case "triangular":
+		return value * triangular(r.Float64(), d.Min, d.Mode, d.Max)
+	case "uniform":
+		return value * (d.Min + r.Float64()*(d.Max-d.Min))
+	}
+	return value
+}
+
+// triangular is the inverse cdf of the triangular distribution at p
+func triangular(p float64, min float64, mode float64, max float64) float64 {
+	if max == min {
+		return min
+	}
+	f := (mode - min) / (max - min)
+	if p < f {
+		return min + math.Sqrt(p*(max-min)*(mode-min))
+	}
+	return max - math.Sqrt((1-p)*(max-min)*(max-mode))
+}
+
+// AttributeDistributions are the distributions of the uncertain attributes
+// of an occupancy type
+type AttributeDistributions struct {
+	FoundHt   Distribution `json:"found_ht"`
+	ValStruct Distribution `json:"val_struct"`
+	ValCont   Distribution `json:"val_cont"`
+}
+
+// DefaultDistributions are used for occupancy types without distributions
+var DefaultDistributions = AttributeDistributions{
+	FoundHt:   Distribution{Type: "normal", Sd: 0.5},
+	ValStruct: Distribution{Type: "triangular", Min: 0.8, Mode: 1, Max: 1.2},
+	ValCont:   Distribution{Type: "triangular", Min: 0.8, Mode: 1, Max: 1.2},
+}
+
+// Realization is one draw of the uncertain attributes of a structure
+type Realization struct {
+	Number    int
+	FoundHt   float64
+	ValStruct float64
+	ValCont   float64
+}
+
+// RealizationGenerator draws realizations of structure attributes.  Each
+// structure has its own random stream from the seed and fd_id, so a structure
+// has the same realizations in any area of interest.
+type RealizationGenerator struct {
+	Seed          int64
+	Realizations  int
+	Distributions map[string]AttributeDistributions
+}
+
+// Validate normalizes the occupancy types and checks every distribution
+func (g *RealizationGenerator) Validate(maxRealizations int) error {
+	if g.Realizations < 1 || g.Realizations > maxRealizations {
+		return fmt.Errorf("realizations must be between 1 and %d", maxRealizations)
+	}
+	distributions := make(map[string]AttributeDistributions, len(g.Distributions))
+	for occtype, d := range g.Distributions {
+		for _, attribute := range []*Distribution{&d.FoundHt, &d.ValStruct, &d.ValCont} {
+			if attribute.Type == "" {
+				attribute.Type = "none"
+			}
+			err := attribute.Validate()
+			if err != nil {
+				return fmt.Errorf("%s: %s", occtype, err)
+			}
+		}
+		distributions[strings.ToUpper(strings.TrimSpace(occtype))] = d
+	}
+	g.Distributions = distributions
+	return nil
+}
+
+// DistributionsFor returns the distributions for an occupancy type using the
+// same fallbacks as FunctionSet.FunctionFor
+func (g *RealizationGenerator) DistributionsFor(occtype string) AttributeDistributions {
+	for _, name := range occtypeCandidates(occtype) {
+		if d, ok := g.Distributions[name]; ok {
+			return d
+		}
+	}
+	return DefaultDistributions
+}
+
+// Generate returns the realizations of a structure.  Foundation heights and
+// values are not allowed to go negative.
+func (g *RealizationGenerator) Generate(nsi *stores.Nsi) []Realization {
+	d := g.DistributionsFor(nsi.Occtype)
+	r := rand.New(rand.NewSource(structureSeed(g.Seed, nsi.Fd_id)))
+	realizations := make([]Realization, g.Realizations)
+	for i := range realizations {
+		realizations[i] = Realization{
+			Number:    i + 1,
+			FoundHt:   math.Max(0, d.FoundHt.Sample(r, nsi.Found_ht)),
+			ValStruct: math.Max(0, d.ValStruct.Sample(r, nsi.Val_struct)),
+			ValCont:   math.Max(0, d.ValCont.Sample(r, nsi.Val_cont)),
+		}
+	}
+	return realizations
+}
+
+// structureSeed mixes the seed and fd_id so neighboring structures have
+// unrelated streams
+func structureSeed(seed int64, fdId int32) int64 {
+	z := uint64(seed) + uint64(uint32(fdId))*0x9E3779B97F4A7C15
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return int64(z ^ (z >> 31))
+}
@@ -0,0 +1,124 @@
+package consequences
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+func TestTriangular(t *testing.T) {
+	tests := []struct {
+		name           string
+		p              float64
+		min, mode, max float64
+		want           float64
+	}{
+		{"lower bound", 0, 0.8, 1, 1.2, 0.8},
+		{"mode", 0.5, 0.8, 1, 1.2, 1},
+		{"upper bound", 1, 0.8, 1, 1.2, 1.2},
+		{"lower quartile", 0.125, 0, 1, 2, 0.5},
+		{"upper quartile", 0.875, 0, 1, 2, 1.5},
+		{"mode at min", 0.75, 0, 0, 1, 0.5},
+		{"mode at max", 0.25, 0, 1, 1, 0.5},
+		{"no range", 0.3, 1, 1, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := triangular(tt.p, tt.min, tt.mode, tt.max); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("triangular(%v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTriangularSampleRange(t *testing.T) {
+	d := Distribution{Type: "triangular", Min: 0.8, Mode: 1, Max: 1.2}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if v := d.Sample(r, 100); v < 80 || v > 120 {
+			t.Fatalf("sample %v outside 80 to 120", v)
+		}
+	}
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	structure := stores.Nsi{Fd_id: 42, Occtype: "RES1-1SNB", Found_ht: 2, Val_struct: 1000, Val_cont: 500}
+	neighbor := structure
+	neighbor.Fd_id = 43
+	generator := func(seed int64) *RealizationGenerator {
+		return &RealizationGenerator{Seed: seed, Realizations: 5}
+	}
+	first := generator(7).Generate(&structure)
+	tests := []struct {
+		name  string
+		got   []Realization
+		equal bool
+	}{
+		{"same seed and fd_id", generator(7).Generate(&structure), true},
+		{"after other structures", func() []Realization {
+			g := generator(7)
+			g.Generate(&neighbor)
+			return g.Generate(&structure)
+		}(), true},
+		{"other seed", generator(8).Generate(&structure), false},
+		{"other fd_id", generator(7).Generate(&neighbor), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reflect.DeepEqual(tt.got, first) != tt.equal {
+				t.Errorf("realizations %v, first %v, want equal %v", tt.got, first, tt.equal)
+			}
+		})
+	}
+	for i, r := range first {
+		if r.Number != i+1 || r.FoundHt < 0 || r.ValStruct < 800 || r.ValStruct > 1200 {
+			t.Errorf("realization %+v", r)
+		}
+	}
+}
+
+func TestGenerateDistributions(t *testing.T) {
+	g := &RealizationGenerator{
+		Seed:         1,
+		Realizations: 3,
+		Distributions: map[string]AttributeDistributions{
+			" res1 ": {FoundHt: Distribution{Type: "none"}, ValStruct: Distribution{Type: "uniform", Min: 2, Max: 2}},
+		},
+	}
+	if err := g.Validate(10); err != nil {
+		t.Fatal(err)
+	}
+	structure := stores.Nsi{Fd_id: 1, Occtype: "RES1-2SNB", Found_ht: 3, Val_struct: 100, Val_cont: 50}
+	for _, r := range g.Generate(&structure) {
+		if r.FoundHt != 3 || r.ValStruct != 200 || r.ValCont != 50 {
+			t.Errorf("realization %+v, want found_ht 3, val_struct 200 and val_cont 50", r)
+		}
+	}
+}
+
+func TestRealizationGeneratorValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		realizations  int
+		distributions map[string]AttributeDistributions
+		ok            bool
+	}{
+		{"defaults", 10, nil, true},
+		{"no realizations", 0, nil, false},
+		{"too many realizations", 11, nil, false},
+		{"invalid type", 1, map[string]AttributeDistributions{"RES1": {FoundHt: Distribution{Type: "beta"}}}, false},
+		{"negative sd", 1, map[string]AttributeDistributions{"RES1": {FoundHt: Distribution{Type: "normal", Sd: -1}}}, false},
+		{"mode outside range", 1, map[string]AttributeDistributions{"RES1": {ValCont: Distribution{Type: "triangular", Min: 1, Mode: 0.5, Max: 2}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &RealizationGenerator{Realizations: tt.realizations, Distributions: tt.distributions}
+			if err := g.Validate(10); (err == nil) != tt.ok {
+				t.Errorf("Validate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
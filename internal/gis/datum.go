@@ -0,0 +1,187 @@
+package gis
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	ogr "github.com/lukeroth/gdal"
+)
+
+const feetToMeters = 0.3048
+
+// NsiVerticalDatum is the datum of the NSI ground elevations
+const NsiVerticalDatum = "NAVD88"
+
+// VerticalDatums are the crs first floor elevations can be converted to,
+// keyed by datum name.  PROJ needs the geoid and datum grids of the
+// transformations in its search path or the datum is unavailable.
+var VerticalDatums = map[string]string{
+	"NAVD88":  "EPSG:4269+5703",
+	"NGVD29":  "EPSG:4267+5702",
+	"EGM96":   "EPSG:4326+5773",
+	"EGM2008": "EPSG:4326+3855",
+}
+
+// datumGrids are the grid files of the datums added by AddDatumGrids
+var datumGrids = map[string]string{}
+
+// unavailableDatums are the datums whose transformations are missing grids
+var unavailableDatums = map[string]error{}
+
+// datumProbe is a point in Kansas covered by the NAVD88, NGVD29 and global
+// geoid grids, where every datum differs from NAVD88
+var datumProbe = [2]float64{-98.5, 39.5}
+
+// AddDatumGrids adds datums defined by local geoid grid files (GTX or
+// GeoTIFF) giving heights in meters above the NAD83 ellipsoid
+func AddDatumGrids(grids map[string]string) {
+	for name, grid := range grids {
+		name = strings.ToUpper(name)
+		VerticalDatums[name] = fmt.Sprintf("+proj=longlat +datum=NAD83 +geoidgrids=%s +vunits=m +no_defs", grid)
+		datumGrids[name] = grid
+	}
+}
+
+// CheckDatumGrids marks the datums that cannot be converted to as
+// unavailable.  When a grid is missing PROJ falls back to a ballpark
+// transformation that leaves heights unchanged, so each datum converts an
+// elevation at a probe point and must shift it.  The probe point of a grid
+// datum is the center of its grid.  PROJ 9.2 and later also refuse ballpark
+// transformations with PROJ_ONLY_BEST_DEFAULT set.
+func CheckDatumGrids() {
+	if os.Getenv("PROJ_ONLY_BEST_DEFAULT") == "" {
+		os.Setenv("PROJ_ONLY_BEST_DEFAULT", "YES")
+	}
+	for datum := range VerticalDatums {
+		if datum == NsiVerticalDatum {
+			continue
+		}
+		err := probeDatum(datum)
+		if err != nil {
+			unavailableDatums[datum] = err
+			log.Printf("Vertical datum %s is unavailable: %s", datum, err)
+		}
+	}
+}
+
+func probeDatum(datum string) error {
+	x, y := datumProbe[0], datumProbe[1]
+	if grid, ok := datumGrids[datum]; ok {
+		g, err := OpenGrid(grid)
+		if err != nil {
+			return fmt.Errorf("unable to read grid %s: %s", grid, err)
+		}
+		minX, minY, maxX, maxY := g.Bounds()
+		g.Close()
+		x, y = (minX+maxX)/2, (minY+maxY)/2
+	}
+	fc, err := newFfeConverter(4326, datum, true)
+	if err != nil {
+		return err
+	}
+	defer fc.Close()
+	v, ok := fc.Convert(x, y, 0)
+	if !ok || math.Abs(v) < 1e-6 {
+		return fmt.Errorf("PROJ has no grid based transformation from %s at %g,%g", NsiVerticalDatum, x, y)
+	}
+	return nil
+}
+
+// FfeOptions select the vertical datum and units of first floor elevations
+type FfeOptions struct {
+	Datum  string
+	Meters bool
+}
+
+// FfeConverter computes first floor elevations from the NSI ground
+// elevation and foundation height in feet NAVD88, converting them to another
+// vertical datum and units
+type FfeConverter struct {
+	Datum  string
+	Meters bool
+	ct     *ogr.CoordinateTransform
+}
+
+// NewFfeConverter creates a converter for points in the srid crs.  Datums
+// found unavailable by CheckDatumGrids are refused.
+func NewFfeConverter(srid int, datum string, meters bool) (*FfeConverter, error) {
+	datum = strings.ToUpper(datum)
+	if err, ok := unavailableDatums[datum]; ok {
+		return nil, fmt.Errorf("Vertical datum %s is unavailable: %s", datum, err)
+	}
+	return newFfeConverter(srid, datum, meters)
+}
+
+func newFfeConverter(srid int, datum string, meters bool) (*FfeConverter, error) {
+	if datum == "" {
+		datum = NsiVerticalDatum
+	}
+	target, ok := VerticalDatums[datum]
+	if !ok {
+		return nil, fmt.Errorf("Unknown vertical datum: %s", datum)
+	}
+	fc := FfeConverter{Datum: datum, Meters: meters}
+	if datum == NsiVerticalDatum {
+		return &fc, nil
+	}
+	sourceCrs := fmt.Sprintf("EPSG:%d+5703", srid)
+	if srid == 4326 {
+		// NAVD88 is realized on NAD83
+		sourceCrs = VerticalDatums[NsiVerticalDatum]
+	}
+	src, err := verticalSpatialReference(sourceCrs)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Destroy()
+	dst, err := verticalSpatialReference(target)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Destroy()
+	ct := ogr.CreateCoordinateTransform(src, dst)
+	fc.ct = &ct
+	return &fc, nil
+}
+
+func verticalSpatialReference(crs string) (ogr.SpatialReference, error) {
+	sr := ogr.CreateSpatialReference("")
+	err := sr.SetFromUserInput(crs)
+	if err != nil {
+		sr.Destroy()
+		return sr, fmt.Errorf("Invalid vertical crs %s: %s", crs, err)
+	}
+	sr.SetAxisMappingStrategy(ogr.OAMS_TraditionalGisOrder)
+	return sr, nil
+}
+
+// Elevation returns the first floor elevation of a structure at x/y.  It is
+// not ok when the point is outside the datum grids.
+func (fc *FfeConverter) Elevation(x float64, y float64, groundElv float64, foundHt float64) (float64, bool) {
+	return fc.Convert(x, y, groundElv+foundHt)
+}
+
+// Convert converts an elevation in feet NAVD88 at x/y
+func (fc *FfeConverter) Convert(x float64, y float64, elevation float64) (float64, bool) {
+	meters := elevation * feetToMeters
+	if fc.ct != nil {
+		xs, ys, zs := []float64{x}, []float64{y}, []float64{meters}
+		if !fc.ct.Transform(1, xs, ys, zs) {
+			return 0, false
+		}
+		meters = zs[0]
+	}
+	if fc.Meters {
+		return meters, true
+	}
+	return meters / feetToMeters, true
+}
+
+func (fc *FfeConverter) Close() {
+	if fc != nil && fc.ct != nil {
+		fc.ct.Destroy()
+	}
+}
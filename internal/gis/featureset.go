@@ -0,0 +1,131 @@
+package gis
+
+import (
+	"net/http"
+
+	ogr "github.com/lukeroth/gdal"
+)
+
+// FeatureSet is the features of an uploaded layer reprojected to EPSG:4326
+// with selected attributes.  Feature n, counting from 1, is geometry n-1 of
+// the Wkb geometry collection so it can be identified after st_dump in
+// postgis.
+type FeatureSet struct {
+	Wkb    []byte
+	Fids   []int64
+	Fields []Field
+	Values [][]interface{}
+	MinX   float64
+	MinY   float64
+	MaxX   float64
+	MaxY   float64
+}
+
+// LayerFields returns the attribute fields of the upload
+func (gd *GeodataPost) LayerFields() ([]Field, error) {
+	layer, err := gd.layer()
+	if err != nil {
+		return nil, err
+	}
+	layerDef := layer.Definition()
+	fields := make([]Field, layerDef.FieldCount())
+	for i := range fields {
+		fd := layerDef.FieldDefinition(i)
+		fieldType := fd.Type()
+		switch fieldType {
+		case ogr.FT_Integer, ogr.FT_Integer64, ogr.FT_Real:
+		default:
+			fieldType = ogr.FT_String
+		}
+		fields[i] = Field{Name: fd.Name(), Type: fieldType}
+	}
+	return fields, nil
+}
+
+// ReadFeatureSet reads the features of the upload with the named attributes.
+// Features must have at least minDimension, 1 for lines and 2 for polygons.
+// Features without a geometry are skipped.
+func (gd *GeodataPost) ReadFeatureSet(names []string, minDimension int) (*FeatureSet, error) {
+	layer, err := gd.layer()
+	if err != nil {
+		return nil, err
+	}
+	ct, err := gd.wgs84Transform(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer ct.Destroy()
+	layerFields, err := gd.LayerFields()
+	if err != nil {
+		return nil, err
+	}
+	fs := FeatureSet{}
+	var indexes []int
+	for _, name := range names {
+		idx := layer.Definition().FieldIndex(name)
+		if idx < 0 {
+			return nil, uploadError(http.StatusBadRequest, "field_not_found", "Uploaded layer does not have a %s field", name)
+		}
+		indexes = append(indexes, idx)
+		fs.Fields = append(fs.Fields, layerFields[idx])
+	}
+	collection := ogr.Create(ogr.GT_GeometryCollection)
+	defer collection.Destroy()
+	vertices := 0
+	layer.ResetReading()
+	for feature := layer.NextFeature(); feature != nil; feature = layer.NextFeature() {
+		err = func() error {
+			defer feature.Destroy()
+			geom, err := gd.featureGeometry(feature, ct, &vertices)
+			if err != nil {
+				return err
+			}
+			if geom.IsEmpty() {
+				geom.Destroy()
+				return nil
+			}
+			if geom.Dimension() < minDimension {
+				geom.Destroy()
+				fid := feature.FID()
+				kind := "a line or polygon"
+				if minDimension == 2 {
+					kind = "a polygon"
+				}
+				err := uploadError(http.StatusBadRequest, "invalid_geometry_type", "Feature %d is not %s", fid, kind)
+				err.Feature = &fid
+				return err
+			}
+			collection.AddGeometryDirectly(geom)
+			fs.Fids = append(fs.Fids, feature.FID())
+			values := make([]interface{}, len(indexes))
+			for i, idx := range indexes {
+				if !feature.IsFieldSet(idx) {
+					continue
+				}
+				switch fs.Fields[i].Type {
+				case ogr.FT_Integer, ogr.FT_Integer64:
+					values[i] = feature.FieldAsInteger64(idx)
+				case ogr.FT_Real:
+					values[i] = feature.FieldAsFloat64(idx)
+				default:
+					values[i] = feature.FieldAsString(idx)
+				}
+			}
+			fs.Values = append(fs.Values, values)
+			return nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fs.Fids) == 0 {
+		return nil, uploadError(http.StatusBadRequest, "empty_upload", "Uploaded layer does not contain any geometries")
+	}
+	env := collection.Envelope()
+	fs.MinX, fs.MinY, fs.MaxX, fs.MaxY = env.MinX(), env.MinY(), env.MaxX(), env.MaxY()
+	fs.Wkb, err = collection.ToWKB()
+	if err != nil {
+		return nil, err
+	}
+	return &fs, nil
+}
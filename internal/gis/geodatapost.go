@@ -1,8 +1,13 @@
 package gis
 
 import (
-	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/google/uuid"
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/utils"
@@ -17,33 +22,226 @@ type GeodataPost struct {
 	ds              ogr.DataSource
 	EchoContext     echo.Context
 	TempStoragePath string
+	LayerName       string // layer name or index in multi-layer sources. defaults to the first layer
+	Crs             string // overrides the crs of the upload, e.g. EPSG:2230
+	BufferMeters    float64
+	MaxBytes        int64 // maximum upload size, uncompressed. zero is unlimited
+	MaxVertices     int   // maximum vertex count of all features. zero is unlimited
+	MakeValid       bool  // repair invalid polygons rather than rejecting them
+}
+
+// UploadError is a problem with the uploaded data that is reported to the
+// client as json with the given http status
+type UploadError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"error"`
+	Message string `json:"message"`
+	Feature *int64 `json:"feature,omitempty"`
+}
+
+func (e *UploadError) Error() string {
+	return e.Message
+}
+
+func uploadError(status int, code string, format string, a ...interface{}) *UploadError {
+	return &UploadError{Status: status, Code: code, Message: fmt.Sprintf(format, a...)}
 }
 
 func (gd *GeodataPost) Close() {
 	gd.ds.Destroy()
+	gd.RemoveTempFiles()
+}
+
+// RemoveTempFiles deletes the temporary copy of the upload
+func (gd *GeodataPost) RemoveTempFiles() {
+	if gd.Guid != "" {
+		os.RemoveAll(gd.TempStoragePath + gd.Guid)
+	}
 }
 
 func (gd *GeodataPost) GetGeometryAsWkb() (*[]uint8, error) {
-	layer := gd.ds.LayerByIndex(0)
-	feature := layer.NextFeature()
-	defer feature.Destroy()
-	fg := feature.Geometry()
-	gdalwkb, err := fg.ToWKB()
+	geom, err := gd.GetGeometry()
+	if err != nil {
+		return nil, err
+	}
+	defer geom.Destroy()
+	gdalwkb, err := geom.ToWKB()
 	if err != nil {
 		return nil, err
 	}
 	return &gdalwkb, nil
 }
 
+// GetGeometry returns every feature in the layer as a single geometry.  Polygon
+// layers are dissolved into one multipolygon, other layers are collected.
+// The caller is responsible for destroying the geometry.
 func (gd *GeodataPost) GetGeometry() (*ogr.Geometry, error) {
-	layer := gd.ds.LayerByIndex(0)
-	feature := layer.NextFeature()
-	defer feature.Destroy()
-	fg := feature.Geometry()
-	filterGeom := fg.Clone()
+	layer, err := gd.layer()
+	if err != nil {
+		return nil, err
+	}
+	ct, err := gd.wgs84Transform(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer ct.Destroy()
+	layer.ResetReading()
+	collection := ogr.Create(ogr.GT_GeometryCollection)
+	polygonal := true
+	count := 0
+	vertices := 0
+	for feature := layer.NextFeature(); feature != nil; feature = layer.NextFeature() {
+		fg, err := gd.featureGeometry(feature, ct, &vertices)
+		feature.Destroy()
+		if err != nil {
+			collection.Destroy()
+			return nil, err
+		}
+		if fg.IsEmpty() {
+			fg.Destroy()
+			continue
+		}
+		polygonal = polygonal && fg.Dimension() == 2
+		collection.AddGeometryDirectly(fg)
+		count++
+	}
+	if count == 0 {
+		collection.Destroy()
+		return nil, uploadError(http.StatusBadRequest, "empty_upload", "Uploaded layer does not contain any geometries")
+	}
+	if !polygonal {
+		return &collection, nil
+	}
+	//ForceToMultiPolygon takes ownership of the collection
+	multiPolygon := collection.ForceToMultiPolygon()
+	defer multiPolygon.Destroy()
+	filterGeom := multiPolygon.UnionCascaded()
 	return &filterGeom, nil
 }
 
+// wgs84Transform returns the transform from the crs of the layer, or the crs given
+// with the upload, to EPSG:4326.  Uploads without a crs are rejected.
+func (gd *GeodataPost) wgs84Transform(layer ogr.Layer) (ogr.CoordinateTransform, error) {
+	var src ogr.SpatialReference
+	if gd.Crs != "" {
+		src = ogr.CreateSpatialReference("")
+		crs := gd.Crs
+		if _, err := strconv.Atoi(crs); err == nil {
+			crs = "EPSG:" + crs
+		}
+		if err := src.SetFromUserInput(crs); err != nil {
+			src.Destroy()
+			return ogr.CoordinateTransform{}, uploadError(http.StatusBadRequest, "invalid_crs", "Invalid crs: %s", gd.Crs)
+		}
+	} else {
+		layerSr := layer.SpatialReference()
+		if layerSr.Validate() != nil {
+			return ogr.CoordinateTransform{}, uploadError(http.StatusBadRequest, "missing_crs", "Uploaded data does not define a coordinate reference system. Include a .prj file or set the crs parameter")
+		}
+		src = layerSr.Clone()
+	}
+	defer src.Destroy()
+	src.SetAxisMappingStrategy(ogr.OAMS_TraditionalGisOrder)
+	dst, err := SpatialReferenceFromEPSG(4326)
+	if err != nil {
+		return ogr.CoordinateTransform{}, err
+	}
+	defer dst.Destroy()
+	return ogr.CreateCoordinateTransform(src, dst), nil
+}
+
+// featureGeometry returns the feature geometry reprojected to EPSG:4326 and
+// buffered when a buffer distance was given.  vertices accumulates the vertex
+// count of the upload.  The caller is responsible for destroying the geometry.
+func (gd *GeodataPost) featureGeometry(feature *ogr.Feature, ct ogr.CoordinateTransform, vertices *int) (ogr.Geometry, error) {
+	geom, err := transformedGeometry(feature, ct)
+	if err != nil || geom.IsEmpty() {
+		return geom, err
+	}
+	*vertices += vertexCount(geom)
+	if gd.MaxVertices > 0 && *vertices > gd.MaxVertices {
+		geom.Destroy()
+		return geom, uploadError(http.StatusRequestEntityTooLarge, "too_many_vertices", "Upload exceeds the maximum of %d vertices", gd.MaxVertices)
+	}
+	geom, err = gd.validGeometry(feature, geom)
+	if err != nil || gd.BufferMeters <= 0 {
+		return geom, err
+	}
+	defer geom.Destroy()
+	buffered, err := BufferMeters(geom, gd.BufferMeters)
+	if err != nil {
+		return buffered, fmt.Errorf("Unable to buffer uploaded geometry: %s", err)
+	}
+	return buffered, nil
+}
+
+// validGeometry rejects invalid geometries, or repairs invalid polygons when
+// MakeValid is set.  validGeometry takes ownership of geom.
+func (gd *GeodataPost) validGeometry(feature *ogr.Feature, geom ogr.Geometry) (ogr.Geometry, error) {
+	if geom.IsValid() {
+		return geom, nil
+	}
+	defer geom.Destroy()
+	fid := feature.FID()
+	if !gd.MakeValid || geom.Dimension() != 2 {
+		err := uploadError(http.StatusUnprocessableEntity, "invalid_geometry", "Feature %d has an invalid geometry. Polygons can be repaired with make_valid=true", fid)
+		err.Feature = &fid
+		return geom, err
+	}
+	//a zero width buffer resolves self intersections
+	repaired := geom.Buffer(0, 30)
+	if repaired.IsEmpty() || !repaired.IsValid() {
+		repaired.Destroy()
+		err := uploadError(http.StatusUnprocessableEntity, "invalid_geometry", "Feature %d has an invalid geometry that could not be repaired", fid)
+		err.Feature = &fid
+		return repaired, err
+	}
+	return repaired, nil
+}
+
+func vertexCount(geom ogr.Geometry) int {
+	count := geom.GeometryCount()
+	if count == 0 {
+		return geom.PointCount()
+	}
+	vertices := 0
+	for i := 0; i < count; i++ {
+		vertices += vertexCount(geom.Geometry(i))
+	}
+	return vertices
+}
+
+// transformedGeometry returns a reprojected copy of the feature geometry.
+// The caller is responsible for destroying the geometry.
+func transformedGeometry(feature *ogr.Feature, ct ogr.CoordinateTransform) (ogr.Geometry, error) {
+	fg := feature.Geometry()
+	if fg.IsNull() {
+		return ogr.Create(ogr.GT_GeometryCollection), nil
+	}
+	geom := fg.Clone()
+	err := geom.Transform(ct)
+	if err != nil {
+		geom.Destroy()
+		return geom, fmt.Errorf("Unable to reproject uploaded geometry to EPSG:4326: %s", err)
+	}
+	return geom, nil
+}
+
+func (gd *GeodataPost) layer() (ogr.Layer, error) {
+	var layer ogr.Layer
+	if gd.LayerName == "" {
+		layer = gd.ds.LayerByIndex(0)
+	} else if idx, err := strconv.Atoi(gd.LayerName); err == nil {
+		layer = gd.ds.LayerByIndex(idx)
+	} else {
+		layer = gd.ds.LayerByName(gd.LayerName)
+	}
+	if layer.IsNull() {
+		return layer, uploadError(http.StatusBadRequest, "layer_not_found", "Unable to find layer %s in uploaded data source", gd.LayerName)
+	}
+	return layer, nil
+}
+
 func (gd *GeodataPost) Open() error {
 	driver := ogr.OGRDriverByName(gd.GDALDriverName)
 	ds, ok := driver.Open(gd.GisFileName, 0)
@@ -51,22 +249,43 @@ func (gd *GeodataPost) Open() error {
 		gd.ds = ds
 		return nil
 	} else {
-		return errors.New("Unable to open gis file data source")
+		return uploadError(http.StatusBadRequest, "unreadable_upload", "Unable to open gis file data source")
 	}
 }
 
+// OpenFromBody opens the gis data posted as the request body.  The body is
+// written to temporary storage and detected the same way as an uploaded file.
 func (gd *GeodataPost) OpenFromBody() error {
-	bodyBytes, err := ioutil.ReadAll(gd.EchoContext.Request().Body)
+	tempDir := gd.newTempDir()
+	err := os.Mkdir(tempDir, os.ModePerm)
 	if err != nil {
 		return err
 	}
-	geojson := string(bodyBytes)
-	if ds, ok := ogr.OpenDataSource(geojson, 0); ok {
-		gd.ds = ds
-		return nil
-	} else {
-		return errors.New("Unable to open gis payload in post body")
+	newfile := filepath.Join(tempDir, "upload")
+	out, err := os.Create(newfile)
+	if err != nil {
+		return err
 	}
+	body := gd.EchoContext.Request().Body
+	if gd.MaxBytes > 0 {
+		body = ioutil.NopCloser(io.LimitReader(body, gd.MaxBytes+1))
+	}
+	size, err := io.Copy(out, body)
+	out.Close()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return uploadError(http.StatusBadRequest, "empty_upload", "The request body is empty")
+	}
+	if gd.MaxBytes > 0 && size > gd.MaxBytes {
+		return gd.tooLargeError()
+	}
+	err = gd.detectFile(newfile)
+	if err != nil {
+		return err
+	}
+	return gd.Open()
 }
 
 func (gd *GeodataPost) HasFile() (bool, error) {
@@ -82,33 +301,64 @@ func (gd *GeodataPost) ExtractFile() error {
 	if err != nil {
 		return err
 	}
-	uuid, _ := uuid.NewUUID()
-	tempname := uuid.String()
-	gd.Guid = tempname
-	newfile, err := utils.CopyPostFileToTemp(gd.TempStoragePath, tempname, file)
-	if err != nil {
-		return err
+	if gd.MaxBytes > 0 && file.Size > gd.MaxBytes {
+		return gd.tooLargeError()
 	}
-	files, err := utils.Unzip(newfile, gd.TempStoragePath+tempname)
+	gd.newTempDir()
+	newfile, err := utils.CopyPostFileToTemp(gd.TempStoragePath, gd.Guid, file)
 	if err != nil {
 		return err
 	}
+	return gd.detectFile(newfile)
+}
+
+func (gd *GeodataPost) newTempDir() string {
+	uuid, _ := uuid.NewUUID()
+	gd.Guid = uuid.String()
+	return gd.TempStoragePath + gd.Guid
+}
+
+// detectFile unzips an uploaded archive and finds the dataset and ogr driver
+// of the upload
+func (gd *GeodataPost) detectFile(newfile string) error {
+	files := []string{newfile}
+	if utils.IsZip(newfile) {
+		size, err := utils.ZipSize(newfile)
+		if err != nil {
+			return uploadError(http.StatusBadRequest, "unreadable_upload", "Unable to read zip archive: %s", err)
+		}
+		if gd.MaxBytes > 0 && size > gd.MaxBytes {
+			return gd.tooLargeError()
+		}
+		files, err = utils.Unzip(newfile, gd.TempStoragePath+gd.Guid)
+		if err != nil {
+			return uploadError(http.StatusBadRequest, "unreadable_upload", "Unable to extract zip archive: %s", err)
+		}
+	}
 	gisFiletype, gisFileName, err := utils.GetGisFileType(files)
 	gd.GisFileName = gisFileName
 	if err != nil {
-		return err
+		return uploadError(http.StatusBadRequest, "unsupported_format", err.Error())
 	}
 	ogrDriverName, err := utils.GetGdalDriverName(gisFiletype)
 	gd.GDALDriverName = ogrDriverName
 	if err != nil {
 		return err
 	}
+	if gisFiletype == utils.CSV {
+		gd.GisFileName, err = utils.WriteCsvVrt(gisFileName)
+		if err != nil {
+			return uploadError(http.StatusBadRequest, "invalid_csv", err.Error())
+		}
+	}
 	return nil
 }
 
-func geometryProcessor(fg *ogr.Geometry) {
-	fg.Buffer(0, 1)
-	sr := ogr.CreateSpatialReference("")
-	sr.FromEPSG(4326)
-	fg.TransformTo(sr)
+func (gd *GeodataPost) tooLargeError() error {
+	return TooLargeError(gd.MaxBytes)
+}
+
+// TooLargeError is the error of an upload larger than maxBytes
+func TooLargeError(maxBytes int64) *UploadError {
+	return uploadError(http.StatusRequestEntityTooLarge, "upload_too_large", "Upload exceeds the maximum size of %d MB", maxBytes/1024/1024)
 }
@@ -3,10 +3,12 @@ package gis
 import (
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	s "strings"
 
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/utils"
 
 	ogr "github.com/lukeroth/gdal"
 	"github.com/paulmach/orb"
@@ -29,6 +31,51 @@ type Db2FileEtl struct {
 	FileOut      string
 	NewLayerName string
 	Guid         string
+	StoreKey     string
+	ZipOutput    bool
+	Srid         int     // crs of the output layer. defaults to the crs of the query
+	Layout       *Layout // consequence tool schema the output is validated against
+	Ffe          *FfeOptions
+}
+
+type ExportFormat struct {
+	Driver       string
+	Extension    string
+	LayerOptions []string
+	Zip          bool // multi-file outputs are written to a directory and zipped
+	Tables       bool // the format holds tables beside the features, see PointWriter.WriteTable
+	// rough output sizes used for export estimates
+	BytesPerFeature float64
+	BytesPerField   float64
+}
+
+var ExportFormats = map[string]ExportFormat{
+	"gpkg":    {Driver: "GPKG", Extension: "gpkg", LayerOptions: []string{"GEOMETRY_NAME=shape"}, Tables: true, BytesPerFeature: 120, BytesPerField: 12},
+	"geojson": {Driver: "GeoJSON", Extension: "geojson", BytesPerFeature: 90, BytesPerField: 24},
+	"csv":     {Driver: "CSV", Extension: "csv", LayerOptions: []string{"GEOMETRY=AS_XY"}, BytesPerFeature: 40, BytesPerField: 10},
+	"shp":     {Driver: "ESRI Shapefile", Extension: "zip", Zip: true, BytesPerFeature: 20, BytesPerField: 6},
+}
+
+// optionalFormats are export formats whose drivers are only in some gdal
+// builds
+var optionalFormats = map[string]ExportFormat{
+	"parquet": {Driver: "Parquet", Extension: "parquet", BytesPerFeature: 30, BytesPerField: 4},
+}
+
+// RegisterOptionalFormats adds the optional formats with a gdal driver to the
+// export formats
+func RegisterOptionalFormats() {
+	for name, format := range optionalFormats {
+		if _, err := ogr.GetDriverByName(format.Driver); err != nil {
+			log.Printf("The gdal %s driver is not available. %s exports are disabled.", format.Driver, name)
+			continue
+		}
+		ExportFormats[name] = format
+	}
+}
+
+func (ef ExportFormat) EstimateSize(featureCount int64, fieldCount int) int64 {
+	return int64(float64(featureCount) * (ef.BytesPerFeature + ef.BytesPerField*float64(fieldCount)))
 }
 
 type ProgressReporter interface {
@@ -47,13 +94,45 @@ func (cr ConsoleReporter) Message(msg string, count int) {
 	}
 }
 
-func RunDb2FileEtl(etl *Db2FileEtl, tempStore *stores.TempStore, tempStoragePath string, reporter ProgressReporter) {
+func RunDb2FileEtl(etl *Db2FileEtl, tempStore *stores.TempStore, tempStoragePath string, fileStore stores.FileStore, reporter ProgressReporter) {
 	defer func() {
 		if etl.GeomFilter != nil {
 			etl.GeomFilter.Destroy()
 		}
 	}()
 	tempStore.PutStatus(etl.Guid, "Processing")
+	count, ok := runDb2File(etl, tempStoragePath, reporter)
+	if !ok {
+		tempStore.PutStatus(etl.Guid, "Failed")
+		return
+	}
+	//the output datasource must be closed before the file is moved to the file store
+	localFile := tempStoragePath + etl.FileOut
+	defer os.RemoveAll(localFile)
+	if etl.ZipOutput {
+		zipFile := localFile + ".zip"
+		defer os.Remove(zipFile)
+		err := utils.ZipDir(localFile, zipFile)
+		if err != nil {
+			reporter.Message(fmt.Sprintf("Unable to zip %s: %s", localFile, err), 0)
+			tempStore.PutStatus(etl.Guid, "Failed")
+			return
+		}
+		localFile = zipFile
+	}
+	err := stores.PutFile(fileStore, etl.StoreKey, localFile)
+	if err != nil {
+		reporter.Message(fmt.Sprintf("Unable to write %s to the file store: %s", etl.StoreKey, err), 0)
+		tempStore.PutStatus(etl.Guid, "Failed")
+		return
+	}
+	tempStore.UpdateJob(etl.Guid, func(job *stores.Job) {
+		job.Status = "Completed"
+		job.FeatureCount = count
+	})
+}
+
+func runDb2File(etl *Db2FileEtl, tempStoragePath string, reporter ProgressReporter) (count int, ok bool) {
 	driverIn := ogr.OGRDriverByName(etl.DbDriver)
 	dburl := fmt.Sprintf(etl.UrlTemplate, etl.Host, etl.Db, etl.User, etl.Pass)
 	dsIn, okIn := driverIn.Open(dburl, 0)
@@ -61,64 +140,186 @@ func RunDb2FileEtl(etl *Db2FileEtl, tempStore *stores.TempStore, tempStoragePath
 		dsIn.Destroy()
 		if r := recover(); r != nil {
 			reporter.Message(fmt.Sprintf("Recovered from %s\n", r), 0)
+			count, ok = 0, false
 		}
 	}()
 	if !okIn {
 		reporter.Message("Unable to open DB datasource", 0)
+		return 0, false
+	}
+	reporter.Message("Opened DB datasource", 0)
+	driverOut := ogr.OGRDriverByName(etl.FileDriver)
+	dsOut, okOut := driverOut.Create(tempStoragePath+etl.FileOut, []string{})
+	defer dsOut.Destroy()
+
+	if !okOut {
+		reporter.Message(fmt.Sprintf("Unable to open ouput datasource:%s", tempStoragePath+etl.FileOut), 0)
+		return 0, false
+	}
+	var layer ogr.Layer
+	if etl.GeomFilter == nil {
+		filter := ogr.Create(ogr.GT_None)
+		layer = dsIn.ExecuteSQL(etl.Sql, filter, etl.DbDialect)
 	} else {
-		reporter.Message("Opened DB datasource", 0)
-		driverOut := ogr.OGRDriverByName(etl.FileDriver)
-		dsOut, okOut := driverOut.Create(tempStoragePath+etl.FileOut, []string{})
-		defer dsOut.Destroy()
-
-		if !okOut {
-			reporter.Message(fmt.Sprintf("Unable to open ouput datasource:%s", tempStoragePath+etl.FileOut), 0)
-		} else {
-			var layer ogr.Layer
-			if etl.GeomFilter == nil {
-				filter := ogr.Create(ogr.GT_None)
-				layer = dsIn.ExecuteSQL(etl.Sql, filter, etl.DbDialect)
-			} else {
-				layer = dsIn.ExecuteSQL(etl.Sql, *etl.GeomFilter, etl.DbDialect)
-			}
+		layer = dsIn.ExecuteSQL(etl.Sql, *etl.GeomFilter, etl.DbDialect)
+	}
 
-			if !layer.IsNull() {
-				defer dsIn.ReleaseResultSet(layer)
-				copyFeatures(layer, dsOut, etl, reporter)
-			} else {
-				reporter.Message("Unable to Retrieve Layer", 0)
-			}
-		}
+	if layer.IsNull() {
+		reporter.Message("Unable to Retrieve Layer", 0)
+		return 0, false
 	}
-	tempStore.PutStatus(etl.Guid, "Completed")
+	defer dsIn.ReleaseResultSet(layer)
+	return copyFeatures(layer, dsOut, etl, reporter)
 }
 
-func copyFeatures(layer ogr.Layer, dsOut ogr.DataSource, etl *Db2FileEtl, reporter ProgressReporter) {
+func copyFeatures(layer ogr.Layer, dsOut ogr.DataSource, etl *Db2FileEtl, reporter ProgressReporter) (int, bool) {
 	sr := layer.SpatialReference()
+	if etl.Srid != 0 {
+		outSr, err := SpatialReferenceFromEPSG(etl.Srid)
+		if err != nil {
+			reporter.Message(err.Error(), 0)
+			return 0, false
+		}
+		defer outSr.Destroy()
+		sr = outSr
+	}
 	newLayer := dsOut.CreateLayer(etl.NewLayerName, sr, ogr.GT_Point, etl.DbOptions) //forcing point data type.  source type (using lyaer.type()) from postgis was a generic geometry
 	if !newLayer.IsNull() {
 		layerDef := layer.Definition()
 		for i := 0; i < layerDef.FieldCount(); i++ {
 			newLayer.CreateField(layerDef.FieldDefinition(i), false)
 		}
+		if etl.Layout != nil {
+			if err := etl.Layout.ValidateLayer(newLayer); err != nil {
+				reporter.Message(err.Error(), 0)
+				return 0, false
+			}
+		}
+		var ffe *FfeConverter
+		ffeIndex := -1
+		if etl.Ffe != nil {
+			srid := etl.Srid
+			if srid == 0 {
+				srid = 4326
+			}
+			var err error
+			ffe, err = NewFfeConverter(srid, etl.Ffe.Datum, etl.Ffe.Meters)
+			if err != nil {
+				reporter.Message(err.Error(), 0)
+				return 0, false
+			}
+			defer ffe.Close()
+			ffeIndex = layerDef.FieldIndex("ffe")
+		}
 		isReading := true
 		var c int = 0
-		for c = 1; isReading; c++ {
+		var invalid error
+		for isReading {
 			func() {
 				feature := layer.NextFeature()
 				if feature != nil {
 					defer feature.Destroy()
+					if ffeIndex >= 0 {
+						convertFfe(feature, ffeIndex, ffe)
+					}
+					if etl.Layout != nil {
+						invalid = etl.Layout.ValidateFeature(feature)
+						if invalid != nil {
+							isReading = false
+							return
+						}
+					}
 					newLayer.Create(*feature)
+					c++
 					reporter.Message(etl.FileOut+": Copying feature ", c)
 				} else {
 					isReading = false
 				}
 			}()
 		}
+		if invalid != nil {
+			reporter.Message(invalid.Error(), 0)
+			return c, false
+		}
 		reporter.Message(fmt.Sprintf("%s: Completed Export of %d features", etl.FileOut, c), 0)
+		return c, true
 	} else {
 		reporter.Message("Unable to create output layer", 0)
+		return 0, false
+	}
+}
+
+// convertFfe converts the ffe field of a feature from feet NAVD88
+func convertFfe(feature *ogr.Feature, index int, ffe *FfeConverter) {
+	if !feature.IsFieldSet(index) {
+		return
+	}
+	geom := feature.Geometry()
+	v, ok := ffe.Convert(geom.X(0), geom.Y(0), feature.FieldAsFloat64(index))
+	if ok {
+		feature.SetFieldFloat64(index, v)
+	} else {
+		feature.UnnsetField(index)
+	}
+}
+
+// SpatialReferenceFromEPSG creates a spatial reference using x/y (lon/lat) axis order
+func SpatialReferenceFromEPSG(epsg int) (ogr.SpatialReference, error) {
+	sr := ogr.CreateSpatialReference("")
+	err := sr.FromEPSG(epsg)
+	if err != nil {
+		sr.Destroy()
+		return sr, fmt.Errorf("Invalid EPSG code: %d", epsg)
+	}
+	sr.SetAxisMappingStrategy(ogr.OAMS_TraditionalGisOrder)
+	return sr, nil
+}
+
+// BufferMeters buffers an EPSG:4326 geometry by a distance in meters using the
+// UTM zone containing the centroid of the geometry.  The caller is responsible
+// for destroying the returned geometry.
+func BufferMeters(geom ogr.Geometry, meters float64) (ogr.Geometry, error) {
+	centroid := geom.Centroid()
+	lon, lat := centroid.X(0), centroid.Y(0)
+	centroid.Destroy()
+	zone := int((lon+180)/6) + 1
+	if zone < 1 {
+		zone = 1
+	} else if zone > 60 {
+		zone = 60
+	}
+	epsg := 32600 + zone
+	if lat < 0 {
+		epsg = 32700 + zone
+	}
+	wgs84, err := SpatialReferenceFromEPSG(4326)
+	if err != nil {
+		return geom, err
+	}
+	defer wgs84.Destroy()
+	utm, err := SpatialReferenceFromEPSG(epsg)
+	if err != nil {
+		return geom, err
+	}
+	defer utm.Destroy()
+	toUtm := ogr.CreateCoordinateTransform(wgs84, utm)
+	defer toUtm.Destroy()
+	toWgs84 := ogr.CreateCoordinateTransform(utm, wgs84)
+	defer toWgs84.Destroy()
+
+	projected := geom.Clone()
+	defer projected.Destroy()
+	err = projected.Transform(toUtm)
+	if err != nil {
+		return geom, err
+	}
+	buffered := projected.Buffer(meters, 8)
+	err = buffered.Transform(toWgs84)
+	if err != nil {
+		buffered.Destroy()
+		return geom, err
 	}
+	return buffered, nil
 }
 
 func StringToCoords(bboxParam string) (*[]float64, error) {
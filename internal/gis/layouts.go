@@ -0,0 +1,257 @@
+package gis
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	ogr "github.com/lukeroth/gdal"
+)
+
+// LayoutField is a column of a consequence tool structure inventory computed
+// from the NSI columns.  Required fields must have a value for every
+// structure, so their expressions leave missing values null.
+type LayoutField struct {
+	Name     string
+	Expr     string
+	Type     ogr.FieldType
+	Required bool
+}
+
+// Layout is the structure inventory schema read by a consequence tool.
+// Depths and elevations are in feet and values in dollars, as in the NSI.
+type Layout struct {
+	Name          string
+	Formats       []string // export formats the tool reads
+	DefaultFormat string
+	Fields        []LayoutField
+	OcctypeField  string
+	DamcatField   string
+	Damcats       []string // damage categories of the tool
+}
+
+// occupancyTypes are the Hazus occupancy classes that name the default
+// occupancy types of HEC-FIA, HEC-LifeSim and go-consequences.  Single
+// family residences add the number of stories (1S, 2S, 3S or SL for split
+// level) and whether there is a basement (WB) or not (NB).
+var occupancyTypes = regexp.MustCompile(`^(RES1-(1S|2S|3S|SL)(NB|WB)|RES2|RES3[A-F]|RES[4-6]|COM([1-9]|10)|IND[1-6]|AGR1|REL1|GOV[12]|EDU[12])$`)
+
+var damcatCodes = []string{"RES", "COM", "IND", "PUB"}
+
+// damcatNames converts the NSI damage category codes to the names HEC-FIA
+// uses.  Unknown codes are left empty so they fail validation.
+const damcatNames = `case st_damcat when 'RES' then 'Residential' when 'COM' then 'Commercial'
+	when 'IND' then 'Industrial' when 'PUB' then 'Public' else '' end`
+
+// HEC-LifeSim chooses building stability criteria by construction type.  NSI
+// building types are codes and RES2 structures are manufactured homes
+// whatever their building type.
+const constructionTypes = `case when occtype like 'RES2%' then 'Manufactured' else case bldgtype
+	when 'W' then 'Wood' when 'M' then 'Masonry' when 'C' then 'Concrete' when 'S' then 'Steel'
+	when 'H' then 'Manufactured' else '' end end`
+
+func textColumn(column string) string {
+	return fmt.Sprintf("coalesce(%s,'')::varchar", column)
+}
+
+func realColumn(column string) string {
+	return fmt.Sprintf("coalesce(%s,0)::double precision", column)
+}
+
+func intColumn(column string) string {
+	return fmt.Sprintf("coalesce(%s,0)::integer", column)
+}
+
+func requiredReal(column string) string {
+	return fmt.Sprintf("%s::double precision", column)
+}
+
+func requiredInt(column string) string {
+	return fmt.Sprintf("%s::integer", column)
+}
+
+var occtypeColumn = "upper(" + textColumn("occtype") + ")"
+
+// Layouts are the structure inventory layouts of the HEC consequence tools
+// keyed by the export layout parameter
+var Layouts = map[string]Layout{
+	// HEC-FIA structure import. Damage categories use the HEC-FIA names.
+	"hec-fia": {
+		Name:          "HEC-FIA",
+		Formats:       []string{"shp", "gpkg"},
+		DefaultFormat: "shp",
+		Fields: []LayoutField{
+			{"St_Name", "fd_id::varchar", ogr.FT_String, true},
+			{"X", requiredReal("x"), ogr.FT_Real, true},
+			{"Y", requiredReal("y"), ogr.FT_Real, true},
+			{"OccType", occtypeColumn, ogr.FT_String, true},
+			{"DamCat", damcatNames, ogr.FT_String, true},
+			{"Found_Ht", requiredReal("found_ht"), ogr.FT_Real, true},
+			{"Found_Type", textColumn("found_type"), ogr.FT_String, false},
+			{"Ground_Elv", realColumn("ground_elv"), ogr.FT_Real, false},
+			{"Num_Struct", "1::integer", ogr.FT_Integer, true},
+			{"Stories", intColumn("num_story"), ogr.FT_Integer, false},
+			{"Year", intColumn("yrbuilt"), ogr.FT_Integer, false},
+			{"Val_Struct", requiredReal("val_struct"), ogr.FT_Real, true},
+			{"Val_Cont", requiredReal("val_cont"), ogr.FT_Real, true},
+			{"Val_Other", realColumn("val_vehic"), ogr.FT_Real, false},
+			{"CBFips", textColumn("cbfips"), ogr.FT_String, false},
+			{"Pop2amu65", intColumn("pop2amu65"), ogr.FT_Integer, false},
+			{"Pop2amo65", intColumn("pop2amo65"), ogr.FT_Integer, false},
+			{"Pop2pmu65", intColumn("pop2pmu65"), ogr.FT_Integer, false},
+			{"Pop2pmo65", intColumn("pop2pmo65"), ogr.FT_Integer, false},
+		},
+		OcctypeField: "OccType",
+		DamcatField:  "DamCat",
+		Damcats:      []string{"Residential", "Commercial", "Industrial", "Public"},
+	},
+	// HEC-LifeSim structure inventory.  Life loss needs the population by
+	// age and time of day, the construction type and the number of stories,
+	// which sets the refuge height of the occupants.
+	"hec-lifesim": {
+		Name:          "HEC-LifeSim",
+		Formats:       []string{"shp", "gpkg"},
+		DefaultFormat: "shp",
+		Fields: []LayoutField{
+			{"Struct_ID", "fd_id::varchar", ogr.FT_String, true},
+			{"X", requiredReal("x"), ogr.FT_Real, true},
+			{"Y", requiredReal("y"), ogr.FT_Real, true},
+			{"OccType", occtypeColumn, ogr.FT_String, true},
+			{"DamCat", textColumn("st_damcat"), ogr.FT_String, true},
+			{"ConstType", constructionTypes, ogr.FT_String, true},
+			{"NumStories", "greatest(" + requiredInt("num_story") + ",1)", ogr.FT_Integer, true},
+			{"Found_Ht", requiredReal("found_ht"), ogr.FT_Real, true},
+			{"Found_Type", textColumn("found_type"), ogr.FT_String, false},
+			{"Ground_Elv", realColumn("ground_elv"), ogr.FT_Real, false},
+			{"Val_Struct", requiredReal("val_struct"), ogr.FT_Real, true},
+			{"Val_Cont", requiredReal("val_cont"), ogr.FT_Real, true},
+			{"Pop2amu65", requiredInt("pop2amu65"), ogr.FT_Integer, true},
+			{"Pop2amo65", requiredInt("pop2amo65"), ogr.FT_Integer, true},
+			{"Pop2pmu65", requiredInt("pop2pmu65"), ogr.FT_Integer, true},
+			{"Pop2pmo65", requiredInt("pop2pmo65"), ogr.FT_Integer, true},
+			{"CBFips", textColumn("cbfips"), ogr.FT_String, false},
+		},
+		OcctypeField: "OccType",
+		DamcatField:  "DamCat",
+		Damcats:      damcatCodes,
+	},
+	// go-consequences nsi structure provider, which reads the nsi column
+	// names and damage category codes
+	"go-consequences": {
+		Name:          "go-consequences",
+		Formats:       []string{"gpkg", "shp", "geojson"},
+		DefaultFormat: "gpkg",
+		Fields: []LayoutField{
+			{"fd_id", "fd_id::integer", ogr.FT_Integer, true},
+			{"x", requiredReal("x"), ogr.FT_Real, true},
+			{"y", requiredReal("y"), ogr.FT_Real, true},
+			{"cbfips", textColumn("cbfips"), ogr.FT_String, false},
+			{"occtype", occtypeColumn, ogr.FT_String, true},
+			{"st_damcat", textColumn("st_damcat"), ogr.FT_String, true},
+			{"bldgtype", textColumn("bldgtype"), ogr.FT_String, false},
+			{"found_type", textColumn("found_type"), ogr.FT_String, false},
+			{"found_ht", requiredReal("found_ht"), ogr.FT_Real, true},
+			{"num_story", intColumn("num_story"), ogr.FT_Integer, false},
+			{"sqft", realColumn("sqft"), ogr.FT_Real, false},
+			{"med_yr_blt", intColumn("med_yr_blt"), ogr.FT_Integer, false},
+			{"val_struct", requiredReal("val_struct"), ogr.FT_Real, true},
+			{"val_cont", requiredReal("val_cont"), ogr.FT_Real, true},
+			{"val_vehic", realColumn("val_vehic"), ogr.FT_Real, false},
+			{"ground_elv", realColumn("ground_elv"), ogr.FT_Real, false},
+			{"firmzone", textColumn("firmzone"), ogr.FT_String, false},
+			{"pop2amu65", intColumn("pop2amu65"), ogr.FT_Integer, false},
+			{"pop2amo65", intColumn("pop2amo65"), ogr.FT_Integer, false},
+			{"pop2pmu65", intColumn("pop2pmu65"), ogr.FT_Integer, false},
+			{"pop2pmo65", intColumn("pop2pmo65"), ogr.FT_Integer, false},
+		},
+		OcctypeField: "occtype",
+		DamcatField:  "st_damcat",
+		Damcats:      damcatCodes,
+	},
+}
+
+// Columns returns the sql select list of the layout fields
+func (l Layout) Columns() string {
+	columns := make([]string, len(l.Fields))
+	for i, f := range l.Fields {
+		columns[i] = fmt.Sprintf(`%s as "%s"`, f.Expr, f.Name)
+	}
+	return strings.Join(columns, ",")
+}
+
+func (l Layout) FieldNames() []string {
+	names := make([]string, len(l.Fields))
+	for i, f := range l.Fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// ValidateFormat checks the tool reads the export format and the format can
+// hold the layout field names
+func (l Layout) ValidateFormat(format string) error {
+	found := false
+	for _, f := range l.Formats {
+		found = found || f == format
+	}
+	if !found {
+		return fmt.Errorf("%s layout is only available as %s", l.Name, strings.Join(l.Formats, ", "))
+	}
+	if ExportFormats[format].Driver == "ESRI Shapefile" {
+		for _, f := range l.Fields {
+			if len(f.Name) > 10 {
+				return fmt.Errorf("%s field %s is too long for a shapefile", l.Name, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateLayer checks an output layer has exactly the layout fields, in
+// order and with the layout types
+func (l Layout) ValidateLayer(layer ogr.Layer) error {
+	def := layer.Definition()
+	if def.FieldCount() != len(l.Fields) {
+		return fmt.Errorf("%s output has %d fields, expected %d", l.Name, def.FieldCount(), len(l.Fields))
+	}
+	for i, f := range l.Fields {
+		fd := def.FieldDefinition(i)
+		if fd.Name() != f.Name || fd.Type() != f.Type {
+			return fmt.Errorf("%s output field %d is %s, expected %s", l.Name, i, fd.Name(), f.Name)
+		}
+	}
+	return nil
+}
+
+// ValidateRecord checks a structure has a value for every required field, an
+// occupancy type the tool has a default for and one of the tool damage
+// categories.  value returns a field as a string and whether it is set.
+func (l Layout) ValidateRecord(id string, value func(field string) (string, bool)) error {
+	for _, f := range l.Fields {
+		v, ok := value(f.Name)
+		if f.Required && (!ok || v == "") {
+			return fmt.Errorf("%s structure %s has no %s", l.Name, id, f.Name)
+		}
+	}
+	if occtype, _ := value(l.OcctypeField); !occupancyTypes.MatchString(occtype) {
+		return fmt.Errorf("%s has no occupancy type %s for structure %s", l.Name, occtype, id)
+	}
+	damcat, _ := value(l.DamcatField)
+	for _, d := range l.Damcats {
+		if d == damcat {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no damage category %s for structure %s", l.Name, damcat, id)
+}
+
+// ValidateFeature checks an output feature with ValidateRecord
+func (l Layout) ValidateFeature(feature *ogr.Feature) error {
+	return l.ValidateRecord(feature.FieldAsString(0), func(field string) (string, bool) {
+		idx := feature.FieldIndex(field)
+		if idx < 0 || !feature.IsFieldSet(idx) {
+			return "", false
+		}
+		return feature.FieldAsString(idx), true
+	})
+}
@@ -0,0 +1,130 @@
+package gis
+
+import (
+	"errors"
+	"fmt"
+
+	ogr "github.com/lukeroth/gdal"
+)
+
+// Field is an attribute written by a PointWriter
+type Field struct {
+	Name string
+	Type ogr.FieldType
+}
+
+// PointWriter writes EPSG:4326 point features with attributes to a new file
+// in one of the export formats
+type PointWriter struct {
+	ds     ogr.DataSource
+	layer  ogr.Layer
+	fields []Field
+}
+
+func NewPointWriter(path string, format ExportFormat, layerName string, fields []Field) (*PointWriter, error) {
+	driver := ogr.OGRDriverByName(format.Driver)
+	ds, ok := driver.Create(path, []string{})
+	if !ok {
+		return nil, fmt.Errorf("Unable to create output datasource: %s", path)
+	}
+	w := PointWriter{ds: ds, fields: fields}
+	sr, err := SpatialReferenceFromEPSG(4326)
+	if err != nil {
+		ds.Destroy()
+		return nil, err
+	}
+	defer sr.Destroy()
+	layer, err := w.createLayer(layerName, sr, ogr.GT_Point, format.LayerOptions, fields)
+	if err != nil {
+		ds.Destroy()
+		return nil, err
+	}
+	w.layer = layer
+	return &w, nil
+}
+
+func (w *PointWriter) createLayer(name string, sr ogr.SpatialReference, geomType ogr.GeometryType, options []string, fields []Field) (ogr.Layer, error) {
+	layer := w.ds.CreateLayer(name, sr, geomType, options)
+	if layer.IsNull() {
+		return layer, fmt.Errorf("Unable to create output layer %s", name)
+	}
+	for _, field := range fields {
+		fd := ogr.CreateFieldDefinition(field.Name, field.Type)
+		err := layer.CreateField(fd, false)
+		fd.Destroy()
+		if err != nil {
+			return layer, err
+		}
+	}
+	return layer, nil
+}
+
+// Write adds a point with values in the order of the writer fields.  Values
+// may be int, int32, int64, float64 or string.
+func (w *PointWriter) Write(x float64, y float64, values []interface{}) error {
+	feature := w.layer.Definition().Create()
+	defer feature.Destroy()
+	err := setFields(feature, values)
+	if err != nil {
+		return err
+	}
+	point := ogr.Create(ogr.GT_Point)
+	point.SetPoint2D(0, x, y)
+	err = feature.SetGeometryDirectly(point)
+	if err != nil {
+		return err
+	}
+	return w.layer.Create(feature)
+}
+
+// WriteTable adds a layer without geometry, for formats that support more
+// than one layer
+func (w *PointWriter) WriteTable(name string, fields []Field, rows [][]interface{}) error {
+	if !w.ds.TestCapability("CreateLayer") {
+		return errors.New("Output format does not support multiple layers")
+	}
+	layer, err := w.createLayer(name, ogr.SpatialReference{}, ogr.GT_None, []string{}, fields)
+	if err != nil {
+		return err
+	}
+	for _, values := range rows {
+		err = func() error {
+			feature := layer.Definition().Create()
+			defer feature.Destroy()
+			err := setFields(feature, values)
+			if err != nil {
+				return err
+			}
+			return layer.Create(feature)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *PointWriter) Close() {
+	w.ds.Destroy()
+}
+
+func setFields(feature ogr.Feature, values []interface{}) error {
+	for i, value := range values {
+		switch v := value.(type) {
+		case int:
+			feature.SetFieldInteger64(i, int64(v))
+		case int32:
+			feature.SetFieldInteger64(i, int64(v))
+		case int64:
+			feature.SetFieldInteger64(i, v)
+		case float64:
+			feature.SetFieldFloat64(i, v)
+		case string:
+			feature.SetFieldString(i, v)
+		case nil:
+		default:
+			return fmt.Errorf("Unsupported field value %v", value)
+		}
+	}
+	return nil
+}
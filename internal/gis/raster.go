@@ -0,0 +1,108 @@
+package gis
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	ogr "github.com/lukeroth/gdal"
+)
+
+// Grid samples the first band of a raster at EPSG:4326 coordinates
+type Grid struct {
+	ds        ogr.Dataset
+	band      ogr.RasterBand
+	inverse   [6]float64
+	noData    float64
+	hasNoData bool
+	toGrid    ogr.CoordinateTransform
+	toWgs84   ogr.CoordinateTransform
+}
+
+func OpenGrid(path string) (*Grid, error) {
+	ds, err := ogr.Open(path, ogr.ReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open raster: %s", err)
+	}
+	if ds.RasterCount() < 1 {
+		ds.Close()
+		return nil, errors.New("Uploaded raster does not contain any bands")
+	}
+	projection := ds.Projection()
+	if projection == "" {
+		ds.Close()
+		return nil, errors.New("Uploaded raster does not define a coordinate reference system")
+	}
+	gridSr := ogr.CreateSpatialReference("")
+	defer gridSr.Destroy()
+	err = gridSr.FromWKT(projection)
+	if err != nil {
+		ds.Close()
+		return nil, fmt.Errorf("Unable to read the raster coordinate reference system: %s", err)
+	}
+	gridSr.SetAxisMappingStrategy(ogr.OAMS_TraditionalGisOrder)
+	wgs84, err := SpatialReferenceFromEPSG(4326)
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+	defer wgs84.Destroy()
+	g := Grid{
+		ds:      ds,
+		band:    ds.RasterBand(1),
+		inverse: ogr.InvGeoTransform(ds.GeoTransform()),
+		toGrid:  ogr.CreateCoordinateTransform(wgs84, gridSr),
+		toWgs84: ogr.CreateCoordinateTransform(gridSr, wgs84),
+	}
+	g.noData, g.hasNoData = g.band.NoDataValue()
+	return &g, nil
+}
+
+// Bounds returns the EPSG:4326 extent of the raster.  Points along each edge
+// are transformed so curved edges of projected rasters are covered.
+func (g *Grid) Bounds() (minX float64, minY float64, maxX float64, maxY float64) {
+	const steps = 20
+	gt := g.ds.GeoTransform()
+	width, height := float64(g.ds.RasterXSize()), float64(g.ds.RasterYSize())
+	var xs, ys []float64
+	for i := 0; i <= steps; i++ {
+		f := float64(i) / steps
+		for _, p := range [][2]float64{{f * width, 0}, {f * width, height}, {0, f * height}, {width, f * height}} {
+			xs = append(xs, gt[0]+p[0]*gt[1]+p[1]*gt[2])
+			ys = append(ys, gt[3]+p[0]*gt[4]+p[1]*gt[5])
+		}
+	}
+	g.toWgs84.Transform(len(xs), xs, ys, make([]float64, len(xs)))
+	minX, minY, maxX, maxY = math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i := range xs {
+		minX, maxX = math.Min(minX, xs[i]), math.Max(maxX, xs[i])
+		minY, maxY = math.Min(minY, ys[i]), math.Max(maxY, ys[i])
+	}
+	return minX, minY, maxX, maxY
+}
+
+// Sample returns the cell value at lon/lat.  Points outside the raster and
+// nodata cells are not ok.
+func (g *Grid) Sample(lon float64, lat float64) (float64, bool) {
+	xs, ys, zs := []float64{lon}, []float64{lat}, []float64{0}
+	if !g.toGrid.Transform(1, xs, ys, zs) {
+		return 0, false
+	}
+	col := int(math.Floor(g.inverse[0] + xs[0]*g.inverse[1] + ys[0]*g.inverse[2]))
+	row := int(math.Floor(g.inverse[3] + xs[0]*g.inverse[4] + ys[0]*g.inverse[5]))
+	if col < 0 || row < 0 || col >= g.ds.RasterXSize() || row >= g.ds.RasterYSize() {
+		return 0, false
+	}
+	buf := make([]float64, 1)
+	err := g.band.IO(ogr.Read, col, row, 1, 1, buf, 1, 1, 0, 0)
+	if err != nil || math.IsNaN(buf[0]) || (g.hasNoData && buf[0] == g.noData) {
+		return 0, false
+	}
+	return buf[0], true
+}
+
+func (g *Grid) Close() {
+	g.toGrid.Destroy()
+	g.toWgs84.Destroy()
+	g.ds.Close()
+}
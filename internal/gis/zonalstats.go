@@ -0,0 +1,210 @@
+package gis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	ogr "github.com/lukeroth/gdal"
+)
+
+// Summarizer computes the inventory summary within a feature geometry
+type Summarizer func(geom ogr.Geometry) (*stores.NsiSummary, error)
+
+func (gd *GeodataPost) FeatureCount() (int, error) {
+	layer, err := gd.layer()
+	if err != nil {
+		return 0, err
+	}
+	count, _ := layer.FeatureCount(true)
+	return count, nil
+}
+
+// WriteZonalStatsGeojson streams each uploaded feature as a geojson feature
+// with its original attributes and the summary of the structures it contains
+func (gd *GeodataPost) WriteZonalStatsGeojson(w io.Writer, summarize Summarizer) (int, error) {
+	layer, err := gd.layer()
+	if err != nil {
+		return 0, err
+	}
+	ct, err := gd.wgs84Transform(layer)
+	if err != nil {
+		return 0, err
+	}
+	defer ct.Destroy()
+	layer.ResetReading()
+	w.Write([]byte(`{"type": "FeatureCollection","features":[`))
+	count := 0
+	vertices := 0
+	for feature := layer.NextFeature(); feature != nil; feature = layer.NextFeature() {
+		err = func() error {
+			defer feature.Destroy()
+			geom, err := gd.featureGeometry(feature, ct, &vertices)
+			if err != nil {
+				return err
+			}
+			defer geom.Destroy()
+			summary, err := summarize(geom)
+			if err != nil {
+				return err
+			}
+			props := FeatureProperties(feature)
+			names, values := SummaryValues(summary)
+			for i, name := range names {
+				props[name] = values[i]
+			}
+			propsJson, err := json.Marshal(props)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				w.Write([]byte(","))
+			}
+			w.Write([]byte(`{"type": "Feature","geometry":`))
+			w.Write([]byte(geom.ToJSON()))
+			w.Write([]byte(`,"properties":`))
+			w.Write(propsJson)
+			w.Write([]byte("}\n"))
+			return nil
+		}()
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	w.Write([]byte("]}"))
+	return count, nil
+}
+
+// WriteZonalStatsFile writes the uploaded features with their summaries to a
+// new file using the given ogr driver
+func (gd *GeodataPost) WriteZonalStatsFile(path string, format ExportFormat, summarize Summarizer) (int, error) {
+	layer, err := gd.layer()
+	if err != nil {
+		return 0, err
+	}
+	ct, err := gd.wgs84Transform(layer)
+	if err != nil {
+		return 0, err
+	}
+	defer ct.Destroy()
+	sr, err := SpatialReferenceFromEPSG(4326)
+	if err != nil {
+		return 0, err
+	}
+	defer sr.Destroy()
+	layer.ResetReading()
+	driver := ogr.OGRDriverByName(format.Driver)
+	dsOut, ok := driver.Create(path, []string{})
+	if !ok {
+		return 0, fmt.Errorf("Unable to create output datasource: %s", path)
+	}
+	defer dsOut.Destroy()
+	geomType := layer.Type()
+	if gd.BufferMeters > 0 {
+		geomType = ogr.GT_Unknown
+	}
+	newLayer := dsOut.CreateLayer("nsi_stats", sr, geomType, format.LayerOptions)
+	if newLayer.IsNull() {
+		return 0, errors.New("Unable to create output layer")
+	}
+	layerDef := layer.Definition()
+	for i := 0; i < layerDef.FieldCount(); i++ {
+		newLayer.CreateField(layerDef.FieldDefinition(i), false)
+	}
+	names, values := SummaryValues(&stores.NsiSummary{})
+	for i, name := range names {
+		fieldType := ogr.FT_Real
+		switch values[i].(type) {
+		case int32, int64:
+			fieldType = ogr.FT_Integer64
+		}
+		fd := ogr.CreateFieldDefinition(name, fieldType)
+		newLayer.CreateField(fd, false)
+		fd.Destroy()
+	}
+	newLayerDef := newLayer.Definition()
+	count := 0
+	vertices := 0
+	for feature := layer.NextFeature(); feature != nil; feature = layer.NextFeature() {
+		err = func() error {
+			defer feature.Destroy()
+			geom, err := gd.featureGeometry(feature, ct, &vertices)
+			if err != nil {
+				return err
+			}
+			defer geom.Destroy()
+			summary, err := summarize(geom)
+			if err != nil {
+				return err
+			}
+			out := newLayerDef.Create()
+			defer out.Destroy()
+			err = out.SetFrom(*feature, 1)
+			if err != nil {
+				return err
+			}
+			err = out.SetGeometry(geom)
+			if err != nil {
+				return err
+			}
+			names, values := SummaryValues(summary)
+			for i, name := range names {
+				idx := out.FieldIndex(name)
+				switch v := values[i].(type) {
+				case int32:
+					out.SetFieldInteger64(idx, int64(v))
+				case int64:
+					out.SetFieldInteger64(idx, v)
+				case float64:
+					out.SetFieldFloat64(idx, v)
+				}
+			}
+			return newLayer.Create(out)
+		}()
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// FeatureProperties returns the set attributes of an ogr feature keyed by field name
+func FeatureProperties(feature *ogr.Feature) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < feature.FieldCount(); i++ {
+		if !feature.IsFieldSet(i) {
+			continue
+		}
+		fd := feature.FieldDefinition(i)
+		switch fd.Type() {
+		case ogr.FT_Integer:
+			props[fd.Name()] = feature.FieldAsInteger(i)
+		case ogr.FT_Integer64:
+			props[fd.Name()] = feature.FieldAsInteger64(i)
+		case ogr.FT_Real:
+			props[fd.Name()] = feature.FieldAsFloat64(i)
+		default:
+			props[fd.Name()] = feature.FieldAsString(i)
+		}
+	}
+	return props
+}
+
+// SummaryValues returns the json field names and values of a summary
+func SummaryValues(summary *stores.NsiSummary) ([]string, []interface{}) {
+	val := reflect.ValueOf(summary).Elem()
+	names := make([]string, 0, val.NumField())
+	values := make([]interface{}, 0, val.NumField())
+	for i := 0; i < val.NumField(); i++ {
+		if tag, ok := val.Type().Field(i).Tag.Lookup("json"); ok {
+			names = append(names, tag)
+			values = append(values, val.Field(i).Interface())
+		}
+	}
+	return names, values
+}
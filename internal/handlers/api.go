@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
@@ -15,6 +18,7 @@ import (
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/models/types"
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/webhooks"
 	"github.com/labstack/echo"
 
 	//"github.com/paulmach/orb"
@@ -26,9 +30,6 @@ import (
 	"github.com/paulmach/orb/encoding/wkt"
 	"github.com/paulmach/orb/geojson"
 	"github.com/paulmach/orb/project"
-
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 var featureSeparator []byte = []byte(",")
@@ -36,8 +37,15 @@ var featureEnd []byte = []byte("}\n")
 var objectEnd []byte = []byte("}")
 var arrayStart []byte = []byte("[")
 var arrayEnd []byte = []byte("]")
-var featureCollectionStart []byte = []byte(`{"type": "FeatureCollection","features":`)
 var validFipsLengths []int = []int{2, 5, 11, 12, 15}
+var bufferUnits = map[string]float64{
+	"":   1,
+	"m":  1,
+	"ft": 0.3048,
+	"km": 1000,
+	"mi": 1609.344,
+}
+var filterFields []string = []string{"occtype", "st_damcat", "bldgtype", "found_type", "firmzone", "source", "stacked"}
 var proptag string = "prop"
 
 const featureTemplate = `{"type": "Feature","geometry": {"type": "Point","coordinates": [%f, %f]},"properties":`
@@ -52,6 +60,8 @@ const featureTemplate = `{"type": "Feature","geometry": {"type": "Point","coordi
 type ApiHandler struct {
 	TempStore *stores.TempStore
 	DataStore *stores.DbStore
+	FileStore stores.FileStore
+	Webhooks  *webhooks.Sender
 	Config    config.AppConfig
 }
 
@@ -59,105 +69,85 @@ func (api *ApiHandler) ApiHome(c echo.Context) error {
 	return c.String(http.StatusOK, "National Structures Inventory APIv2")
 }
 
+// GetStatus returns the status of a job.  detail=true returns the whole job,
+// including its summary and webhook deliveries.
 func (api *ApiHandler) GetStatus(c echo.Context) error {
 	id := c.Param("uuid")
-	status, err := api.TempStore.GetStatus(id)
+	if c.QueryParam("detail") != "true" {
+		status, err := api.TempStore.GetStatus(id)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, "{\"status\":\""+status+"\"}")
+	}
+	job, err := api.TempStore.GetJob(id)
 	if err != nil {
 		return err
-	} else {
-		return c.String(http.StatusOK, "{\"status\":\""+status+"\"}")
 	}
+	if job == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, newJobStatus(job, authenticatedUser(c)))
 }
 
 func (api *ApiHandler) DownloadFileDataset(c echo.Context) error {
 	file := c.Param("file")
+	log.Printf("Download request for %s\n", file)
+	return api.sendStoredFile(c, sanitizePath(file), file)
+}
 
-	sess, awsSessErr := session.NewSession()
-	if awsSessErr != nil {
-		return awsSessErr
+func (api *ApiHandler) GetStructure(c echo.Context) error {
+	fdId, err := strconv.ParseInt(c.Param("structureId"), 10, 32)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid fd_id: %s", c.Param("structureId")))
 	}
-	object := api.Config.AwsPrefix + file
-	log.Printf("Download request for %s\n", object)
-
-	result, err := s3.New(sess).GetObject(&s3.GetObjectInput{
-		Bucket: &api.Config.AwsBucket,
-		Key:    &object,
-	})
+	d, err := api.getDataset(c)
 	if err != nil {
 		return err
 	}
-
-	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file))
-	c.Response().Header().Set("Cache-Control", "no-store")
-
-	_, copyErr := io.Copy(c.Response().Writer, result.Body)
-	if copyErr != nil {
-		return copyErr
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
 	}
-	return nil
-}
-
-func (api *ApiHandler) GetStructure(c echo.Context) error {
-	fdId := c.Param("structureId")
+	defer out.Close()
 	criteria := " where fd_id=$1"
 	nsi := stores.Nsi{}
-	err := api.DataStore.Db.Get(&nsi, fmt.Sprintf("%s %s", stores.NsiSelect, criteria), fdId)
+	err = api.DataStore.Db.Get(&nsi, strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName), fdId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Structure %d not found", fdId))
+	}
 	if err != nil {
 		return err
 	}
-	feature := fmt.Sprintf(featureTemplate, nsi.X, nsi.Y)
+	x, y := out.Point(nsi.X, nsi.Y)
+	feature := fmt.Sprintf(featureTemplate, x, y)
 	props, err := json.Marshal(nsi)
 	if err != nil {
 		return err
 	}
+	props = out.properties(&nsi, props)
 	return c.String(http.StatusOK, fmt.Sprintf("%s %s}", feature, props))
 }
 
 func (api *ApiHandler) GetStructures(c echo.Context) error {
-	paramKeys := []string{"quality", "dataset", "version", "fips", "bbox", "fmt"}
-	urlParams := parseUrlParams(&c, paramKeys)
-	// if dataset isn't specified, default to designated
-	if urlParams["dataset"] == "" {
-		urlParams["dataset"] = api.Config.DefaultDatasetName
-		urlParams["version"] = api.Config.DefaultDatasetVersion
-		urlParams["quality"] = api.Config.DefaultDatasetQuality
-	}
-	fips := urlParams["fips"]
-	bbox := urlParams["bbox"]
-	apifmt := urlParams["bbox"]
+	apifmt := c.QueryParam("fmt")
 	if apifmt == "" {
 		apifmt = "fc"
 	}
-	var params []interface{}
-	fipsCriteria, params, err := getFipsCriteria(fips, params)
-	if err != nil {
-		return err
-	}
-	bboxCriteria, err := getBboxCriteria(bbox, 4326)
+	criteria, params, err := getQueryCriteria(c)
 	if err != nil {
 		return err
 	}
-	criteria := buildCritieria(bboxCriteria, fipsCriteria)
 
-	q := models.Quality{
-		Value: types.Quality(urlParams["value"]),
-	}
-	err = api.DataStore.GetQualityId(&q)
+	d, err := api.getDataset(c)
 	if err != nil {
 		return err
 	}
-	d := models.Dataset{
-		Name:      urlParams["dataset"],
-		Version:   urlParams["version"],
-		QualityId: q.Id,
-	}
-	err = api.DataStore.GetDataset(&d)
+	out, err := newOutputCrs(c)
 	if err != nil {
 		return err
 	}
-	if d.Id == uuid.Nil {
-		return fmt.Errorf("dataset not found")
-	}
+	defer out.Close()
 
 	rows, err := api.DataStore.Db.Queryx(strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName), params...)
 	if err != nil {
@@ -165,55 +155,85 @@ func (api *ApiHandler) GetStructures(c echo.Context) error {
 	}
 	defer rows.Close()
 	if apifmt == "fs" {
-		err = rowsToGeojsonStream(c, rows)
+		err = rowsToGeojsonStream(c, rows, &stores.Nsi{}, out)
 	} else {
-		err = rowsToGeojson(c, apifmt, rows)
+		err = rowsToGeojson(c, apifmt, rows, &stores.Nsi{}, out, nil)
 	}
 	return err
 }
 
-func (api *ApiHandler) StructuresFromUpload(c echo.Context) error {
-	geodataPost := gis.GeodataPost{
-		EchoContext:     c,
-		TempStoragePath: api.Config.TempStoragePath,
+// getDataset looks up the dataset given by the dataset, version and quality
+// query parameters, defaulting to the designated dataset
+func (api *ApiHandler) getDataset(c echo.Context) (models.Dataset, error) {
+	paramKeys := []string{"quality", "dataset", "version"}
+	urlParams := parseUrlParams(&c, paramKeys)
+	// if dataset isn't specified, default to designated
+	if urlParams["dataset"] == "" {
+		urlParams["dataset"] = api.Config.DefaultDatasetName
+		urlParams["version"] = api.Config.DefaultDatasetVersion
+		urlParams["quality"] = api.Config.DefaultDatasetQuality
 	}
+	q := models.Quality{
+		Value: types.Quality(urlParams["quality"]),
+	}
+	err := api.DataStore.GetQualityId(&q)
+	if err != nil {
+		return models.Dataset{}, err
+	}
+	d := models.Dataset{
+		Name:      urlParams["dataset"],
+		Version:   urlParams["version"],
+		QualityId: q.Id,
+	}
+	err = api.DataStore.GetDataset(&d)
+	if err != nil {
+		return d, err
+	}
+	if d.Id == uuid.Nil {
+		return d, echo.NewHTTPError(http.StatusNotFound, "dataset not found")
+	}
+	return d, nil
+}
 
+func (api *ApiHandler) StructuresFromUpload(c echo.Context) error {
 	apifmt := c.QueryParam("fmt")
 	if apifmt == "" {
 		apifmt = "fc"
 	}
 
-	if hasFile, err := geodataPost.HasFile(); hasFile {
-		if err != nil {
-			return err
-		}
-		err := geodataPost.ExtractFile()
-		if err != nil {
-			return err
-		}
-		err = geodataPost.Open()
-		if err != nil {
-			return err
-		}
-	} else {
-		geodataPost.OpenFromBody()
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	geodataPost, err := api.openUpload(c)
+	if err != nil {
+		return err
 	}
-
 	defer geodataPost.Close()
 
-	gdalwkb, err := geodataPost.GetGeometryAsWkb()
+	geomCriteria, aoi, err := uploadAoi(geodataPost)
+	if err != nil {
+		return err
+	}
+	criteria, params, err := getQueryCriteria(c, geomCriteria)
 	if err != nil {
 		return err
 	}
-	rows, err := api.DataStore.Db.Queryx(fmt.Sprintf("%s %s", stores.NsiSelect, "where st_intersects(shape,st_geomfromwkb($1,4326))"), gdalwkb)
+	sql := strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName)
+	rows, err := api.DataStore.Db.Queryx(sql, params...)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 	if apifmt == "fs" {
-		err = rowsToGeojsonStream(c, rows)
+		err = rowsToGeojsonStream(c, rows, &stores.Nsi{}, out)
 	} else {
-		err = rowsToGeojson(c, apifmt, rows)
+		err = rowsToGeojson(c, apifmt, rows, &stores.Nsi{}, out, aoi)
 	}
 	if err != nil {
 		return err
@@ -222,9 +242,9 @@ func (api *ApiHandler) StructuresFromUpload(c echo.Context) error {
 }
 
 func (api *ApiHandler) StructuresFromPost(c echo.Context) error {
-	geodataPost := gis.GeodataPost{
-		EchoContext:     c,
-		TempStoragePath: api.Config.TempStoragePath,
+	geodataPost, err := api.newGeodataPost(c)
+	if err != nil {
+		return err
 	}
 
 	apifmt := c.QueryParam("fmt")
@@ -232,24 +252,35 @@ func (api *ApiHandler) StructuresFromPost(c echo.Context) error {
 		apifmt = "fc"
 	}
 
-	err := geodataPost.OpenFromBody()
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	out, err := newOutputCrs(c)
 	if err != nil {
 		return err
 	}
+	defer out.Close()
+	err = geodataPost.OpenFromBody()
+	if err != nil {
+		geodataPost.RemoveTempFiles()
+		return uploadHTTPError(err)
+	}
 	defer geodataPost.Close()
 	gdalwkb, err := geodataPost.GetGeometryAsWkb()
 	if err != nil {
-		return err
+		return uploadHTTPError(err)
 	}
-	rows, err := api.DataStore.Db.Queryx(fmt.Sprintf("%s %s", stores.NsiSelect, "where st_intersects(shape,st_geomfromwkb($1,4326))"), gdalwkb)
+	sql := strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, "where st_intersects(shape,st_geomfromwkb($1,4326))"), "{table_name}", d.TableName)
+	rows, err := api.DataStore.Db.Queryx(sql, gdalwkb)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 	if apifmt == "fs" {
-		err = rowsToGeojsonStream(c, rows)
+		err = rowsToGeojsonStream(c, rows, &stores.Nsi{}, out)
 	} else {
-		err = rowsToGeojson(c, apifmt, rows)
+		err = rowsToGeojson(c, apifmt, rows, &stores.Nsi{}, out, nil)
 	}
 	if err != nil {
 		return err
@@ -258,86 +289,61 @@ func (api *ApiHandler) StructuresFromPost(c echo.Context) error {
 }
 
 func (api *ApiHandler) CreateExport(c echo.Context) error {
-	bbox := c.QueryParam("bbox")
-	bboxCriteria, err := getBboxCriteria(bbox, 4326)
-	if err != nil {
-		return err
-	}
-	sql := fmt.Sprintf("select * from nsi where %s", bboxCriteria)
-	uuid, _ := uuid.NewUUID()
-	name := uuid.String()
-	api.TempStore.PutStatus(name, "Initialized")
-	etl := gis.Db2FileEtl{
-		DbDriver:     "PostgreSQL",
-		UrlTemplate:  "PG: host=%s dbname=%s user=%s password=%s",
-		DbDialect:    "POSTGRESQL",
-		DbOptions:    []string{"GEOMETRY_NAME=shape"},
-		User:         api.Config.Dbuser,
-		Pass:         api.Config.Dbpass,
-		Host:         api.Config.Dbhost,
-		Db:           api.Config.Dbname,
-		Sql:          sql,
-		FileDriver:   "GPKG",
-		NewLayerName: "nsi_export",
-		FileOut:      name + ".gpkg",
-		Guid:         name,
-	}
-	go gis.RunDb2FileEtl(&etl, api.TempStore, api.Config.TempStoragePath, &gis.ConsoleReporter{})
-	c.String(http.StatusOK, name)
-	return nil
+	er, err := api.newExportRequest(c)
+	if err != nil {
+		return err
+	}
+	er.Criteria, er.Params, err = getQueryCriteria(c)
+	if err != nil {
+		return err
+	}
+	return api.submitExport(c, er)
 }
 
 func (api *ApiHandler) ExportFromUpload(c echo.Context) error {
-	geodataPost := gis.GeodataPost{
-		EchoContext:     c,
-		TempStoragePath: api.Config.TempStoragePath,
-	}
-	err := geodataPost.ExtractFile()
+	er, err := api.newExportRequest(c)
 	if err != nil {
 		return err
 	}
-	err = geodataPost.Open()
+	geodataPost, err := api.openUpload(c)
 	if err != nil {
 		return err
 	}
 	defer geodataPost.Close()
 	filterGeom, err := geodataPost.GetGeometry()
+	if err != nil {
+		return uploadHTTPError(err)
+	}
+	defer filterGeom.Destroy()
+	er.Aoi, err = filterGeom.ToWKB()
 	if err != nil {
 		return err
 	}
-	uuidVal, _ := uuid.NewUUID()
-	name := uuidVal.String()
-	etl := gis.Db2FileEtl{
-		DbDriver:     "PostgreSQL",
-		UrlTemplate:  "PG: host=%s dbname=%s user=%s password=%s",
-		DbDialect:    "POSTGRESQL",
-		DbOptions:    []string{"GEOMETRY_NAME=shape"},
-		User:         api.Config.Dbuser,
-		Pass:         api.Config.Dbpass,
-		Host:         api.Config.Dbhost,
-		Db:           api.Config.Dbname,
-		Sql:          "select * from nsi",
-		GeomFilter:   filterGeom,
-		FileDriver:   "GPKG",
-		NewLayerName: "nsi_export",
-		FileOut:      name + ".gpkg",
-		Guid:         name,
-	}
-	go gis.RunDb2FileEtl(&etl, api.TempStore, api.Config.TempStoragePath, &gis.ConsoleReporter{})
-	c.String(http.StatusOK, name)
-
-	return nil
+	if geodataPost.BufferMeters > 0 {
+		er.AoiGeojson = json.RawMessage(filterGeom.ToJSON())
+	}
+	geomWkt, err := filterGeom.ToWKT()
+	if err != nil {
+		return err
+	}
+	er.Criteria, er.Params, err = getQueryCriteria(c, getGeometryCriteria(geomWkt, 4326))
+	if err != nil {
+		return err
+	}
+	return api.submitExport(c, er)
 }
 
 func (api *ApiHandler) GetStats(c echo.Context) error {
-	bbox := c.QueryParam("bbox")
-	bboxCriteria, err := getBboxCriteria(bbox, 4326)
+	criteria, params, err := getQueryCriteria(c)
+	if err != nil {
+		return err
+	}
+	d, err := api.getDataset(c)
 	if err != nil {
 		return err
 	}
-	criteria := buildCritieria(bboxCriteria, "")
 	var nsiSummary stores.NsiSummary
-	err = api.DataStore.Db.Get(&nsiSummary, fmt.Sprintf("%s %s", stores.NsiStatsSelect, criteria))
+	err = api.DataStore.Db.Get(&nsiSummary, strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiStatsSelect, criteria), "{table_name}", d.TableName), params...)
 	if err == nil {
 		c.JSON(http.StatusOK, &nsiSummary)
 	}
@@ -345,39 +351,37 @@ func (api *ApiHandler) GetStats(c echo.Context) error {
 }
 
 func (api *ApiHandler) StatsFromUpload(c echo.Context) error {
-	geodataPost := gis.GeodataPost{
-		EchoContext:     c,
-		TempStoragePath: api.Config.TempStoragePath,
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
 	}
-
-	if hasFile, err := geodataPost.HasFile(); hasFile {
-		if err != nil {
-			return err
-		}
-		err := geodataPost.ExtractFile()
-		if err != nil {
-			return err
-		}
-		err = geodataPost.Open()
-		if err != nil {
-			return err
-		}
-	} else {
-		geodataPost.OpenFromBody()
+	geodataPost, err := api.openUpload(c)
+	if err != nil {
+		return err
+	}
+	if c.QueryParam("per_feature") == "true" {
+		return api.perFeatureStats(c, d, geodataPost)
 	}
-
 	defer geodataPost.Close()
-	gdalwkb, err := geodataPost.GetGeometryAsWkb()
+	geomCriteria, aoi, err := uploadAoi(geodataPost)
+	if err != nil {
+		return err
+	}
+	criteria, params, err := getQueryCriteria(c, geomCriteria)
 	if err != nil {
 		return err
 	}
 
 	var nsiSummary stores.NsiSummary
-	err = api.DataStore.Db.Get(&nsiSummary, fmt.Sprintf("%s %s", stores.NsiStatsSelect, "where st_intersects(shape,st_geomfromwkb($1,4326))"), gdalwkb)
+	sql := strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiStatsSelect, criteria), "{table_name}", d.TableName)
+	err = api.DataStore.Db.Get(&nsiSummary, sql, params...)
 	if err != nil {
 		return err
 	}
-	c.JSON(http.StatusOK, &nsiSummary)
+	c.JSON(http.StatusOK, struct {
+		stores.NsiSummary
+		Aoi json.RawMessage `json:"aoi,omitempty"`
+	}{nsiSummary, aoi})
 
 	return nil
 }
@@ -388,9 +392,22 @@ func (api *ApiHandler) GetExport(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	path := fmt.Sprintf("%s%s.%s", api.Config.TempStoragePath, uuid.String(), "gpkg")
-	path = sanitizePath(path)
-	return c.Attachment(path, "nsi_export.gpkg")
+	job, err := api.TempStore.GetJob(uuid.String())
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return echo.ErrNotFound
+	}
+	if job.Status == "Expired" {
+		return echo.NewHTTPError(http.StatusGone, "export has expired")
+	}
+	format := job.Format
+	if format == "" {
+		format = "gpkg"
+	}
+	filename := "nsi_export." + gis.ExportFormats[format].Extension
+	return api.sendStoredFile(c, api.exportKey(uuid.String(), format), filename)
 }
 
 func (api *ApiHandler) GetHexbins(c echo.Context) error {
@@ -423,11 +440,158 @@ func (api *ApiHandler) GetHexbins(c echo.Context) error {
 //  private util funcs
 ////////////////////////////////////////////////////////
 
+// uploadAoi returns the criteria selecting structures in the uploaded area of
+// interest.  Buffered areas are also returned as geojson so they can be echoed back in the response.
+func uploadAoi(geodataPost *gis.GeodataPost) (string, json.RawMessage, error) {
+	geom, err := geodataPost.GetGeometry()
+	if err != nil {
+		return "", nil, uploadHTTPError(err)
+	}
+	defer geom.Destroy()
+	geomWkt, err := geom.ToWKT()
+	if err != nil {
+		return "", nil, err
+	}
+	var aoi json.RawMessage
+	if geodataPost.BufferMeters > 0 {
+		aoi = json.RawMessage(geom.ToJSON())
+	}
+	return getGeometryCriteria(geomWkt, 4326), aoi, nil
+}
+
+// parseBuffer returns the buffer parameter in meters.  Units are given by
+// buffer_units and may be m, ft, km or mi, defaulting to meters.
+func parseBuffer(c echo.Context) (float64, error) {
+	buffer := c.QueryParam("buffer")
+	if buffer == "" {
+		return 0, nil
+	}
+	distance, err := strconv.ParseFloat(buffer, 64)
+	if err != nil || distance < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid buffer: %s", buffer))
+	}
+	units := strings.ToLower(c.QueryParam("buffer_units"))
+	toMeters, ok := bufferUnits[units]
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid buffer units: %s", units))
+	}
+	return distance * toMeters, nil
+}
+
+// openUpload opens the zipped gis file in a multipart upload, or the geojson
+// in the request body when there is no file.  The layer parameter selects the
+// layer in multi-layer sources.
+func (api *ApiHandler) openUpload(c echo.Context) (*gis.GeodataPost, error) {
+	api.limitUpload(c)
+	geodataPost, err := api.newGeodataPost(c)
+	if err != nil {
+		return nil, err
+	}
+	hasFile, err := geodataPost.HasFile()
+	if api.isUploadTooLarge(err) {
+		return nil, api.uploadTooLargeError()
+	}
+	if hasFile {
+		err = geodataPost.ExtractFile()
+		if err == nil {
+			err = geodataPost.Open()
+		}
+	} else {
+		err = geodataPost.OpenFromBody()
+	}
+	if err != nil {
+		geodataPost.RemoveTempFiles()
+		if api.isUploadTooLarge(err) {
+			return nil, api.uploadTooLargeError()
+		}
+		return nil, uploadHTTPError(err)
+	}
+	return geodataPost, nil
+}
+
+// limitUpload caps the request body at the upload limit before it is read, so
+// an oversized multipart upload fails while it is parsed rather than after
+// it has been spooled to memory or disk
+func (api *ApiHandler) limitUpload(c echo.Context) {
+	if c.Get(uploadLimitKey) != nil {
+		return
+	}
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, api.Config.UploadMaxMB<<20)
+	c.Set(uploadLimitKey, true)
+}
+
+// isUploadTooLarge tests if err is from reading past the upload limit
+func (api *ApiHandler) isUploadTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+func (api *ApiHandler) uploadTooLargeError() error {
+	return uploadHTTPError(gis.TooLargeError(api.Config.UploadMaxMB << 20))
+}
+
+func (api *ApiHandler) newGeodataPost(c echo.Context) (*gis.GeodataPost, error) {
+	bufferMeters, err := parseBuffer(c)
+	if err != nil {
+		return nil, err
+	}
+	return &gis.GeodataPost{
+		EchoContext:     c,
+		TempStoragePath: api.Config.TempStoragePath,
+		LayerName:       c.QueryParam("layer"),
+		Crs:             c.QueryParam("crs"),
+		BufferMeters:    bufferMeters,
+		MaxBytes:        api.Config.UploadMaxMB * 1024 * 1024,
+		MaxVertices:     api.Config.UploadMaxVertices,
+		MakeValid:       c.QueryParam("make_valid") == "true",
+	}, nil
+}
+
+// uploadHTTPError returns problems with uploaded data as json client errors
+func uploadHTTPError(err error) error {
+	var uploadErr *gis.UploadError
+	if errors.As(err, &uploadErr) {
+		return echo.NewHTTPError(uploadErr.Status, uploadErr)
+	}
+	return err
+}
+
 func sanitizePath(path string) string {
 	path = filepath.Clean(path)
 	return strings.ReplaceAll(path, "..", "")
 }
 
+// baseUrl is the scheme, host and api prefix of the current request
+func baseUrl(c echo.Context) string {
+	return fmt.Sprintf("%s://%s%s", c.Scheme(), c.Request().Host, path.Dir(c.Path()))
+}
+
+// sendStoredFile redirects to a pre-signed url when the file store supports
+// them and they are enabled, otherwise the file is streamed through the api
+func (api *ApiHandler) sendStoredFile(c echo.Context, key string, filename string) error {
+	if api.Config.PresignDownloads {
+		url, err := api.FileStore.PresignedUrl(key, api.Config.PresignExpiration)
+		if err == nil {
+			return c.Redirect(http.StatusTemporaryRedirect, url)
+		}
+		if err != stores.ErrPresignNotSupported {
+			return err
+		}
+	}
+	reader, err := api.FileStore.Get(key)
+	if err != nil {
+		if err == stores.ErrFileNotFound {
+			return echo.ErrNotFound
+		}
+		return err
+	}
+	defer reader.Close()
+
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Stream(http.StatusOK, echo.MIMEOctetStream, reader)
+}
+
 func rowsToGeojsonHb(c echo.Context, rows *sqlx.Rows) error {
 	hb := stores.Hexbin{}
 	writer := c.Response().Writer
@@ -492,23 +656,42 @@ func hexbinRecToProps(hb *stores.Hexbin) string {
 	return builder.String()
 }
 
+// writeCollectionStart opens a feature collection with the optional crs and
+// area of interest members
+func writeCollectionStart(c echo.Context, out *outputCrs, aoi json.RawMessage) {
+	c.Response().Write([]byte(`{"type": "FeatureCollection",` + out.crsMember()))
+	if aoi != nil {
+		c.Response().Write([]byte(`"aoi":`))
+		c.Response().Write(aoi)
+		c.Response().Write([]byte(","))
+	}
+	c.Response().Write([]byte(`"features":`))
+}
+
+// featureRecord is a row written as a geojson point feature
+type featureRecord interface {
+	Point() (float64, float64)
+	Elevations() (float64, float64)
+}
+
 //@TODO this has potential to return mangled json on error
 //need to decide best approch.  mangle or skip...
-func rowsToGeojson(c echo.Context, apifmt string, rows *sqlx.Rows) error {
-	nsi := stores.Nsi{}
+// rowsToGeojson writes the structures as a feature collection or array.  When
+// given, the area of interest is included as a foreign member of the collection.
+func rowsToGeojson(c echo.Context, apifmt string, rows *sqlx.Rows, record featureRecord, out *outputCrs, aoi json.RawMessage) error {
 
 	if apifmt == "fc" {
-		c.Response().Write(featureCollectionStart)
+		writeCollectionStart(c, out, aoi)
 	}
 
 	c.Response().Write(arrayStart)
 	for i := 0; rows.Next(); i++ {
-		err := rows.StructScan(&nsi)
+		err := rows.StructScan(record)
 		if err != nil {
 			log.Printf("Unable to map query to NSI Struct. Msg: %s\n", err)
 			return err
 		}
-		props, err := json.Marshal(nsi)
+		props, err := json.Marshal(record)
 		if err != nil {
 			log.Printf("Unable to encode nsi record to JSON. Msg: %s\n", err)
 			return err
@@ -516,7 +699,9 @@ func rowsToGeojson(c echo.Context, apifmt string, rows *sqlx.Rows) error {
 		if i > 0 {
 			c.Response().Write(featureSeparator)
 		}
-		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, nsi.X, nsi.Y)))
+		props = out.properties(record, props)
+		x, y := out.Point(record.Point())
+		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, x, y)))
 		c.Response().Write(props)
 		c.Response().Write(featureEnd)
 	}
@@ -528,20 +713,21 @@ func rowsToGeojson(c echo.Context, apifmt string, rows *sqlx.Rows) error {
 	return nil
 }
 
-func rowsToGeojsonStream(c echo.Context, rows *sqlx.Rows) error {
-	nsi := stores.Nsi{}
+func rowsToGeojsonStream(c echo.Context, rows *sqlx.Rows, record featureRecord, out *outputCrs) error {
 	for i := 0; rows.Next(); i++ {
-		err := rows.StructScan(&nsi)
+		err := rows.StructScan(record)
 		if err != nil {
 			log.Printf("Unable to map query to NSI Struct. Msg: %s\n", err)
 			return err
 		}
-		props, err := json.Marshal(nsi)
+		props, err := json.Marshal(record)
 		if err != nil {
 			log.Printf("Unable to encode nsi record to JSON. Msg: %s\n", err)
 			return err
 		}
-		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, nsi.X, nsi.Y)))
+		props = out.properties(record, props)
+		x, y := out.Point(record.Point())
+		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, x, y)))
 		c.Response().Write(props)
 		c.Response().Write(featureEnd)
 	}
@@ -549,40 +735,114 @@ func rowsToGeojsonStream(c echo.Context, rows *sqlx.Rows) error {
 	return nil
 }
 
-func buildCritieria(bboxCriteria string, fipsCritiera string) string {
+func buildCritieria(criteria ...string) string {
 	var builder strings.Builder
-	builder.WriteString("where ")
-	if bboxCriteria != "" {
-		builder.WriteString(bboxCriteria)
-	}
-	if fipsCritiera != "" {
-		if bboxCriteria != "" {
+	for _, c := range criteria {
+		if c == "" {
+			continue
+		}
+		if builder.Len() == 0 {
+			builder.WriteString("where ")
+		} else {
 			builder.WriteString(" and ")
 		}
-		builder.WriteString(fipsCritiera)
+		builder.WriteString(c)
 	}
 	//builder.WriteString(fmt.Sprintf(" limit %s", featureLimit))
 	return builder.String()
 }
 
+// getQueryCriteria builds the where clause shared by the structure, stats and export
+// endpoints from the spatial, fips and attribute filter parameters
+func getQueryCriteria(c echo.Context, extraCriteria ...string) (string, []interface{}, error) {
+	var params []interface{}
+	fipsCriteria, params, err := getFipsCriteria(c.QueryParam("fips"), params)
+	if err != nil {
+		return "", nil, err
+	}
+	spatialCriteria, err := getSpatialCriteria(c)
+	if err != nil {
+		return "", nil, err
+	}
+	attributeCriteria, params := getAttributeCriteria(c.QueryParam, params)
+	criteria := append([]string{spatialCriteria, fipsCriteria}, attributeCriteria...)
+	criteria = append(criteria, extraCriteria...)
+	return buildCritieria(criteria...), params, nil
+}
+
+// getFipsCriteria accepts a comma separated list of state, county, tract,
+// block group or block fips codes
 func getFipsCriteria(fips string, params []interface{}) (string, []interface{}, error) {
-	var fipsCriteria string
-	if fips != "" {
-		if !contains(validFipsLengths, len(fips)) {
-			return "", nil, errors.New("Invalid FIPS query")
+	if fips == "" {
+		return "", params, nil
+	}
+	var fipsCriteria []string
+	for _, f := range strings.Split(fips, ",") {
+		f = strings.TrimSpace(f)
+		if !contains(validFipsLengths, len(f)) || !isDigits(f) {
+			return "", nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid FIPS query: %s", f))
 		}
-		params = append(params, fips)
+		params = append(params, f)
 		paramsCount := len(params)
-		fipsLen := len(fips)
+		fipsLen := len(f)
 		if fipsLen == 15 {
-			fipsCriteria = fmt.Sprintf("cbfips=$%d", paramsCount)
+			fipsCriteria = append(fipsCriteria, fmt.Sprintf("cbfips=$%d", paramsCount))
 		} else {
-			fipsCriteria = fmt.Sprintf("substr(cbfips,1,%d)=$%d", fipsLen, paramsCount)
+			fipsCriteria = append(fipsCriteria, fmt.Sprintf("substr(cbfips,1,%d)=$%d", fipsLen, paramsCount))
 		}
-	} else {
-		fipsCriteria = ""
 	}
-	return fipsCriteria, params, nil
+	return "(" + strings.Join(fipsCriteria, " or ") + ")", params, nil
+}
+
+// getAttributeCriteria filters the categorical inventory fields by comma separated
+// lists of values.  A trailing * matches any value with the given prefix.
+func getAttributeCriteria(fieldValues func(string) string, params []interface{}) ([]string, []interface{}) {
+	var criteria []string
+	for _, field := range filterFields {
+		values := fieldValues(field)
+		if values == "" {
+			continue
+		}
+		var fieldCriteria []string
+		for _, v := range strings.Split(values, ",") {
+			v = strings.TrimSpace(v)
+			if strings.HasSuffix(v, "*") {
+				params = append(params, strings.TrimSuffix(v, "*")+"%")
+				fieldCriteria = append(fieldCriteria, fmt.Sprintf("%s like $%d", field, len(params)))
+			} else {
+				params = append(params, v)
+				fieldCriteria = append(fieldCriteria, fmt.Sprintf("%s=$%d", field, len(params)))
+			}
+		}
+		criteria = append(criteria, "("+strings.Join(fieldCriteria, " or ")+")")
+	}
+	return criteria, params
+}
+
+const uploadLimitKey = "upload_limit"
+
+var paramPlaceholder = regexp.MustCompile(`\$\d+`)
+
+// inlineParams replaces the positional parameters in sql with quoted literals.
+// gdal does not support query parameters.  Placeholders are replaced in a
+// single pass so a literal containing $n is never substituted again.
+func inlineParams(sql string, params []interface{}) string {
+	return paramPlaceholder.ReplaceAllStringFunc(sql, func(placeholder string) string {
+		i, err := strconv.Atoi(placeholder[1:])
+		if err != nil || i < 1 || i > len(params) {
+			return placeholder
+		}
+		return "'" + strings.ReplaceAll(fmt.Sprint(params[i-1]), "'", "''") + "'"
+	})
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 func getBboxCriteria(bbox string, crs int) (string, error) {
@@ -607,6 +867,12 @@ func getBboxCriteria(bbox string, crs int) (string, error) {
 	return bboxCriteria, nil
 }
 
+// getGeometryCriteria inlines the geometry so the criteria can also be used
+// by gdal, which does not support query parameters
+func getGeometryCriteria(geomWkt string, srid int) string {
+	return fmt.Sprintf("st_intersects(shape,'SRID=%d;%s')", srid, geomWkt)
+}
+
 // array s contains int e?
 func contains(s []int, e int) bool {
 	for _, a := range s {
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetFipsCriteria(t *testing.T) {
+	tests := []struct {
+		name     string
+		fips     string
+		params   []interface{}
+		criteria string
+		want     []interface{}
+		wantErr  bool
+	}{
+		{"none", "", nil, "", nil, false},
+		{"state", "01", nil, "(substr(cbfips,1,2)=$1)", []interface{}{"01"}, false},
+		{"block", "010010201001000", nil, "(cbfips=$1)", []interface{}{"010010201001000"}, false},
+		{"list", "01001, 02", nil, "(substr(cbfips,1,5)=$1 or substr(cbfips,1,2)=$2)", []interface{}{"01001", "02"}, false},
+		{"after other params", "01", []interface{}{"x"}, "(substr(cbfips,1,2)=$2)", []interface{}{"x", "01"}, false},
+		{"invalid length", "0100", nil, "", nil, true},
+		{"not digits", "0a", nil, "", nil, true},
+		{"injection", "01') or ('1'='1", nil, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			criteria, params, err := getFipsCriteria(tt.fips, tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getFipsCriteria(%q) error = %v, want error %v", tt.fips, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if criteria != tt.criteria || !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("getFipsCriteria(%q) = %q, %v, want %q, %v", tt.fips, criteria, params, tt.criteria, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAttributeCriteria(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]string
+		params   []interface{}
+		criteria []string
+		want     []interface{}
+	}{
+		{"none", map[string]string{}, nil, nil, nil},
+		{"single value", map[string]string{"occtype": "RES1"}, nil, []string{"(occtype=$1)"}, []interface{}{"RES1"}},
+		{"list and prefix", map[string]string{"occtype": "RES1*, COM1"}, nil,
+			[]string{"(occtype like $1 or occtype=$2)"}, []interface{}{"RES1%", "COM1"}},
+		{"fields in filter order", map[string]string{"st_damcat": "RES", "occtype": "RES2"}, []interface{}{"01"},
+			[]string{"(occtype=$2)", "(st_damcat=$3)"}, []interface{}{"01", "RES2", "RES"}},
+		{"unknown fields ignored", map[string]string{"val_struct": "1"}, nil, nil, nil},
+		{"values are parameters", map[string]string{"bldgtype": "W' or '1'='1"}, nil,
+			[]string{"(bldgtype=$1)"}, []interface{}{"W' or '1'='1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			criteria, params := getAttributeCriteria(func(field string) string { return tt.values[field] }, tt.params)
+			if !reflect.DeepEqual(criteria, tt.criteria) || !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("getAttributeCriteria() = %q, %v, want %q, %v", criteria, params, tt.criteria, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		sql    string
+		params []interface{}
+		want   string
+	}{
+		{"no params", "select 1", nil, "select 1"},
+		{"string", "where occtype=$1", []interface{}{"RES1"}, "where occtype='RES1'"},
+		{"number", "where x>$1", []interface{}{1.5}, "where x>'1.5'"},
+		{"quotes", "where bldgtype=$1", []interface{}{"W' or '1'='1"}, "where bldgtype='W'' or ''1''=''1'"},
+		{"ten or more params", "$1,$10", []interface{}{"a", 2, 3, 4, 5, 6, 7, 8, 9, "j"}, "'a','j'"},
+		{"placeholder in a value", "$1,$2", []interface{}{"$2", "b"}, "'$2','b'"},
+		{"unknown placeholder", "$1,$3", []interface{}{"a"}, "'a',$3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inlineParams(tt.sql, tt.params); got != tt.want {
+				t.Errorf("inlineParams(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
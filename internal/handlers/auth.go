@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+const userContextKey = "user"
+
+// Authenticate verifies the HS256 bearer token of a request and stores it in
+// the context.  The user id is the sub claim.  Requests without an
+// Authorization header are anonymous and are refused by the handlers that
+// need a user.  Any other scheme, or a token that does not verify, is refused
+// with 401 rather than treated as anonymous.
+func Authenticate(secret string) echo.MiddlewareFunc {
+	return middleware.JWTWithConfig(middleware.JWTConfig{
+		Skipper: func(c echo.Context) bool {
+			return c.Request().Header.Get(echo.HeaderAuthorization) == ""
+		},
+		SigningKey: []byte(secret),
+		ContextKey: userContextKey,
+		Claims:     &jwt.StandardClaims{},
+		ErrorHandler: func(err error) error {
+			return &echo.HTTPError{Code: http.StatusUnauthorized, Message: "invalid bearer token", Internal: err}
+		},
+	})
+}
+
+// authenticatedUser returns the user id of the verified token of the
+// request, or an empty string for anonymous requests
+func authenticatedUser(c echo.Context) string {
+	token, ok := c.Get(userContextKey).(*jwt.Token)
+	if !ok || !token.Valid {
+		return ""
+	}
+	claims, ok := token.Claims.(*jwt.StandardClaims)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(claims.Subject)
+}
+
+func (api *ApiHandler) userId(c echo.Context) (string, error) {
+	userId := authenticatedUser(c)
+	if userId == "" {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "a bearer token identifying the user is required")
+	}
+	return userId, nil
+}
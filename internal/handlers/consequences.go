@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/consequences"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/utils"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+var damageFields = []gis.Field{
+	{Name: "fd_id", Type: ogr.FT_Integer64},
+	{Name: "occtype", Type: ogr.FT_String},
+	{Name: "st_damcat", Type: ogr.FT_String},
+	{Name: "cbfips", Type: ogr.FT_String},
+	{Name: "found_ht", Type: ogr.FT_Real},
+	{Name: "val_struct", Type: ogr.FT_Real},
+	{Name: "val_cont", Type: ogr.FT_Real},
+	{Name: "depth", Type: ogr.FT_Real},
+	{Name: "floor_depth", Type: ogr.FT_Real},
+	{Name: "ddf", Type: ogr.FT_String},
+	{Name: "no_ddf", Type: ogr.FT_Integer},
+	{Name: "struct_dmg", Type: ogr.FT_Real},
+	{Name: "struct_sd", Type: ogr.FT_Real},
+	{Name: "cont_dmg", Type: ogr.FT_Real},
+	{Name: "cont_sd", Type: ogr.FT_Real},
+}
+
+// consequenceRequest holds the validated parameters of a damage estimate
+type consequenceRequest struct {
+	RasterFile   string
+	WaterSurface bool
+	Meters       bool
+	FipsLength   int
+	Sql          string
+	Params       []interface{}
+}
+
+// Consequences estimates flood damage to the structures covered by an
+// uploaded depth or water surface elevation grid.  The estimate runs as a
+// job, with per structure damages written in the requested format and the
+// totals by damage category and fips recorded in the job summary.  Formats
+// with tables, such as gpkg, also hold the totals as tables.
+func (api *ApiHandler) Consequences(c echo.Context) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	if format == "" {
+		format = "geojson"
+	}
+	exportFormat, ok := gis.ExportFormats[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	cr, err := api.newConsequenceRequest(c)
+	if err != nil {
+		return err
+	}
+	tempDir := filepath.Dir(cr.RasterFile)
+	grid, err := gis.OpenGrid(cr.RasterFile)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	minX, minY, maxX, maxY := grid.Bounds()
+	grid.Close()
+	criteria, params, err := getQueryCriteria(c, fmt.Sprintf("st_intersects(shape,st_makeenvelope(%f,%f,%f,%f,4326))", minX, minY, maxX, maxY))
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	cr.Sql = strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName)
+	cr.Params = params
+	functions, err := api.datasetFunctions(d)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	err = api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		defer os.RemoveAll(tempDir)
+		return api.estimateDamages(cr, localFile, exportFormat, functions)
+	})
+	if err != nil {
+		os.RemoveAll(tempDir)
+	}
+	return err
+}
+
+func (api *ApiHandler) newConsequenceRequest(c echo.Context) (*consequenceRequest, error) {
+	cr := consequenceRequest{FipsLength: 5}
+	switch strings.ToLower(c.QueryParam("hazard")) {
+	case "", "depth":
+	case "wse":
+		cr.WaterSurface = true
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "hazard must be depth or wse")
+	}
+	switch strings.ToLower(c.QueryParam("units")) {
+	case "", "ft":
+	case "m":
+		cr.Meters = true
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "units must be ft or m")
+	}
+	if fipsLevel := c.QueryParam("fips_level"); fipsLevel != "" {
+		fipsLength, err := strconv.Atoi(fipsLevel)
+		if err != nil || !contains(validFipsLengths, fipsLength) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid fips_level: %s", fipsLevel))
+		}
+		cr.FipsLength = fipsLength
+	}
+	rasterFile, err := api.saveRasterUpload(c, "file")
+	if err != nil {
+		return nil, err
+	}
+	cr.RasterFile = rasterFile
+	return &cr, nil
+}
+
+// saveRasterUpload copies the raster in a form field to temporary storage and
+// returns its path
+func (api *ApiHandler) saveRasterUpload(c echo.Context, field string) (string, error) {
+	api.limitUpload(c)
+	file, err := c.FormFile(field)
+	if api.isUploadTooLarge(err) {
+		return "", api.uploadTooLargeError()
+	}
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "a raster file upload is required")
+	}
+	maxBytes := api.Config.UploadMaxMB * 1024 * 1024
+	if file.Size > maxBytes {
+		return "", echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the maximum size of %d MB", api.Config.UploadMaxMB))
+	}
+	uuid, _ := uuid.NewUUID()
+	return utils.CopyPostFileToTemp(api.Config.TempStoragePath, uuid.String(), file)
+}
+
+func (api *ApiHandler) estimateDamages(cr *consequenceRequest, localFile string, format gis.ExportFormat, functions consequences.FunctionSet) (int, interface{}, error) {
+	grid, err := gis.OpenGrid(cr.RasterFile)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer grid.Close()
+	writer, err := gis.NewPointWriter(localFile, format, "nsi_damages", damageFields)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer writer.Close()
+	rows, err := api.DataStore.Db.Queryx(cr.Sql, cr.Params...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	estimator := consequences.NewEstimator(grid, functions, cr.WaterSurface, cr.Meters, cr.FipsLength)
+	nsi := stores.Nsi{}
+	count := 0
+	for rows.Next() {
+		err = rows.StructScan(&nsi)
+		if err != nil {
+			return count, nil, err
+		}
+		r, ok := estimator.Estimate(&nsi)
+		if !ok {
+			continue
+		}
+		noFunction := 0
+		if r.NoFunction {
+			noFunction = 1
+		}
+		err = writer.Write(nsi.X, nsi.Y, []interface{}{
+			nsi.Fd_id, nsi.Occtype, nsi.St_damcat, nsi.CbFips, nsi.Found_ht, nsi.Val_struct, nsi.Val_cont,
+			r.Depth, r.FloorDepth, r.Function, noFunction, r.StructureDamage, r.StructureDamageSd, r.ContentDamage, r.ContentDamageSd,
+		})
+		if err != nil {
+			return count, nil, err
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return count, nil, err
+	}
+	if format.Tables {
+		err = writeDamageTotals(writer, &estimator.Totals)
+		if err != nil {
+			return count, nil, fmt.Errorf("Unable to write damage totals: %s", err)
+		}
+	}
+	return count, &estimator.Totals, nil
+}
+
+var totalFields = []gis.Field{
+	{Name: "structures", Type: ogr.FT_Integer64},
+	{Name: "flooded", Type: ogr.FT_Integer64},
+	{Name: "no_ddf", Type: ogr.FT_Integer64},
+	{Name: "struct_dmg", Type: ogr.FT_Real},
+	{Name: "cont_dmg", Type: ogr.FT_Real},
+}
+
+// writeDamageTotals adds the totals by damage category and fips as tables
+func writeDamageTotals(writer *gis.PointWriter, totals *consequences.Totals) error {
+	for _, table := range []struct {
+		name   string
+		key    string
+		totals map[string]*consequences.Total
+	}{
+		{"totals_by_damcat", "st_damcat", totals.ByDamcat},
+		{"totals_by_fips", "fips", totals.ByFips},
+	} {
+		fields := append([]gis.Field{{Name: table.key, Type: ogr.FT_String}}, totalFields...)
+		var rows [][]interface{}
+		for key, t := range table.totals {
+			rows = append(rows, []interface{}{key, t.Structures, t.Flooded, t.NoFunction, t.StructureDamage, t.ContentDamage})
+		}
+		err := writer.WriteTable(table.name, fields, rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
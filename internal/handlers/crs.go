@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+// outputCrs reprojects feature coordinates from EPSG:4326 to the output crs
+// and adds the first floor elevation in the vertical_datum parameter when
+// ffe=true.  A nil outputCrs leaves coordinates in EPSG:4326.
+type outputCrs struct {
+	Srid int
+	ct   ogr.CoordinateTransform
+	ffe  *gis.FfeConverter
+}
+
+func newOutputCrs(c echo.Context) (*outputCrs, error) {
+	srid, err := getOutputSrid(c)
+	if err != nil {
+		return nil, err
+	}
+	ffe, err := getFfeConverter(c, 4326)
+	if err != nil || (srid == 4326 && ffe == nil) {
+		return nil, err
+	}
+	out := outputCrs{Srid: srid, ffe: ffe}
+	if srid == 4326 {
+		return &out, nil
+	}
+	src, err := gis.SpatialReferenceFromEPSG(4326)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Destroy()
+	dst, err := gis.SpatialReferenceFromEPSG(srid)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Destroy()
+	c.Response().Header().Set("Content-Crs", fmt.Sprintf("<http://www.opengis.net/def/crs/EPSG/0/%d>", srid))
+	out.ct = ogr.CreateCoordinateTransform(src, dst)
+	return &out, nil
+}
+
+// getFfeConverter returns the first floor elevation converter for points in
+// the srid crs when ffe=true.  The vertical_datum parameter defaults to NAVD88
+// and ffe_units may be ft or m.
+func getFfeConverter(c echo.Context, srid int) (*gis.FfeConverter, error) {
+	if c.QueryParam("ffe") != "true" {
+		return nil, nil
+	}
+	meters := false
+	switch strings.ToLower(c.QueryParam("ffe_units")) {
+	case "", "ft":
+	case "m":
+		meters = true
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "ffe_units must be ft or m")
+	}
+	ffe, err := gis.NewFfeConverter(srid, c.QueryParam("vertical_datum"), meters)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return ffe, nil
+}
+
+// getOutputSrid returns the srid of the output crs after checking it is a
+// known EPSG code.  GET queries name it with the crs parameter.  On POST
+// uploads crs is the crs of the uploaded data, so the output crs is the
+// out-crs parameter, which GET queries also accept.
+func getOutputSrid(c echo.Context) (int, error) {
+	name := "out-crs"
+	if c.Request().Method == http.MethodGet && c.QueryParam(name) == "" {
+		name = "crs"
+	}
+	srid, err := parseSrid(name, c.QueryParam(name))
+	if err != nil || srid == 4326 {
+		return srid, err
+	}
+	sr, err := gis.SpatialReferenceFromEPSG(srid)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	sr.Destroy()
+	return srid, nil
+}
+
+func (o *outputCrs) Point(x float64, y float64) (float64, float64) {
+	if o == nil || o.Srid == 4326 {
+		return x, y
+	}
+	xs, ys, zs := []float64{x}, []float64{y}, []float64{0}
+	o.ct.Transform(1, xs, ys, zs)
+	return xs[0], ys[0]
+}
+
+// crsMember names the crs of a feature collection using the crs member of
+// the 2008 geojson spec.  RFC 7946 removed it and only allows EPSG:4326, so
+// clients that follow the RFC may ignore it; it is only written for other
+// crs, where the coordinates are not RFC 7946 geojson anyway.
+func (o *outputCrs) crsMember() string {
+	if o == nil || o.Srid == 4326 {
+		return ""
+	}
+	return fmt.Sprintf(`"crs":{"type":"name","properties":{"name":"urn:ogc:def:crs:EPSG::%d"}},`, o.Srid)
+}
+
+// properties adds the ffe property to the json properties of a record
+func (o *outputCrs) properties(record featureRecord, props []byte) []byte {
+	if o == nil || o.ffe == nil {
+		return props
+	}
+	x, y := record.Point()
+	groundElv, foundHt := record.Elevations()
+	ffe := "null"
+	if v, ok := o.ffe.Elevation(x, y, groundElv, foundHt); ok {
+		ffe = strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	return append(props[:len(props)-1], []byte(`,"ffe":`+ffe+"}")...)
+}
+
+func (o *outputCrs) Close() {
+	if o == nil {
+		return
+	}
+	if o.Srid != 4326 {
+		o.ct.Destroy()
+	}
+	o.ffe.Close()
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/consequences"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/labstack/echo"
+)
+
+type ddfSetSummary struct {
+	Id          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Description string    `json:"description"`
+	DateCreated time.Time `json:"date_created"`
+	CreatedBy   string    `json:"created_by"`
+}
+
+type ddfAssignment struct {
+	Occtype string    `json:"occtype"`
+	DdfId   uuid.UUID `json:"ddf_id"`
+	SetId   uuid.UUID `json:"ddf_set_id"`
+	Name    string    `json:"name"`
+}
+
+// requireAdmin returns the requesting user when they have the admin role
+func (api *ApiHandler) requireAdmin(c echo.Context) (string, error) {
+	userId, err := api.userId(c)
+	if err != nil {
+		return "", err
+	}
+	isAdmin, err := api.DataStore.IsAdmin(userId)
+	if err != nil {
+		return "", err
+	}
+	if !isAdmin {
+		return "", echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+	return userId, nil
+}
+
+func (api *ApiHandler) GetDdfSets(c echo.Context) error {
+	sets, err := api.DataStore.GetDdfSets()
+	if err != nil {
+		return err
+	}
+	summaries := make([]ddfSetSummary, len(sets))
+	for i, set := range sets {
+		summaries[i] = ddfSetSummary(set)
+	}
+	return c.JSON(http.StatusOK, summaries)
+}
+
+// GetDdfSet returns a function set as json, or as csv with format=csv
+func (api *ApiHandler) GetDdfSet(c echo.Context) error {
+	set, err := api.ddfSet(c)
+	if err != nil {
+		return err
+	}
+	ddfs, err := api.DataStore.GetDdfs(set.Id)
+	if err != nil {
+		return err
+	}
+	doc := consequences.FunctionSetDocument{
+		Id:          set.Id.String(),
+		Name:        set.Name,
+		Version:     set.Version,
+		Description: set.Description,
+		Functions:   make([]consequences.DepthDamageFunction, len(ddfs)),
+	}
+	for i, ddf := range ddfs {
+		doc.Functions[i] = consequences.FunctionFromModel(ddf)
+	}
+	switch strings.ToLower(c.QueryParam("format")) {
+	case "", "json":
+		return c.JSON(http.StatusOK, doc)
+	case "csv":
+		filename := fmt.Sprintf("%s_%s.csv", set.Name, set.Version)
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+		c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+		c.Response().WriteHeader(http.StatusOK)
+		return consequences.WriteFunctionsCsv(c.Response(), doc.Functions)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// AddDdfSet imports a function set from a json document, or from csv with
+// the set name, version and description given as parameters
+func (api *ApiHandler) AddDdfSet(c echo.Context) error {
+	userId, err := api.requireAdmin(c)
+	if err != nil {
+		return err
+	}
+	doc, err := api.readFunctionSet(c, "")
+	if err != nil {
+		return err
+	}
+	return api.addDdfSet(c, userId, doc)
+}
+
+// UpdateDdfSet adds a new version of a set.  Versions are never changed, so
+// datasets keep the functions of the version they were assigned, and the
+// estimates made with it can be repeated, until the new version is assigned.
+// The document version must be new and its name, when given, the set name.
+func (api *ApiHandler) UpdateDdfSet(c echo.Context) error {
+	userId, err := api.requireAdmin(c)
+	if err != nil {
+		return err
+	}
+	set, err := api.ddfSet(c)
+	if err != nil {
+		return err
+	}
+	doc, err := api.readFunctionSet(c, set.Name)
+	if err != nil {
+		return err
+	}
+	if doc.Name != set.Name {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("a new version of %s cannot be named %s", set.Name, doc.Name))
+	}
+	if doc.Description == "" {
+		doc.Description = set.Description
+	}
+	return api.addDdfSet(c, userId, doc)
+}
+
+func (api *ApiHandler) addDdfSet(c echo.Context, userId string, doc consequences.FunctionSetDocument) error {
+	sets, err := api.DataStore.GetDdfSets()
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		if set.Name == doc.Name && set.Version == doc.Version {
+			return echo.NewHTTPError(http.StatusConflict,
+				fmt.Sprintf("function set %s version %s already exists", doc.Name, doc.Version))
+		}
+	}
+	set := models.DdfSet{
+		Name:        doc.Name,
+		Version:     doc.Version,
+		Description: doc.Description,
+		CreatedBy:   userId,
+	}
+	err = api.DataStore.AddDdfSet(&set, functionModels(doc.Functions))
+	if err != nil {
+		return err
+	}
+	doc.Id = set.Id.String()
+	return c.JSON(http.StatusCreated, doc)
+}
+
+func (api *ApiHandler) DeleteDdfSet(c echo.Context) error {
+	_, err := api.requireAdmin(c)
+	if err != nil {
+		return err
+	}
+	set, err := api.ddfSet(c)
+	if err != nil {
+		return err
+	}
+	err = api.DataStore.DeleteDdfSet(set.Id)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AssignDdfSet assigns the functions of a set to the occupancy types of the
+// dataset given by the dataset parameters.  The occtype parameter limits the
+// assignment to a single function.
+func (api *ApiHandler) AssignDdfSet(c echo.Context) error {
+	_, err := api.requireAdmin(c)
+	if err != nil {
+		return err
+	}
+	set, err := api.ddfSet(c)
+	if err != nil {
+		return err
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	if occtype := strings.ToUpper(c.QueryParam("occtype")); occtype != "" {
+		ddfs, err := api.DataStore.GetDdfs(set.Id)
+		if err != nil {
+			return err
+		}
+		var ddfId uuid.UUID
+		for _, ddf := range ddfs {
+			if ddf.Occtype == occtype {
+				ddfId = ddf.Id
+			}
+		}
+		if ddfId == uuid.Nil {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("function set has no function for occtype %s", occtype))
+		}
+		err = api.DataStore.AssignDdf(d.Id, occtype, ddfId)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = api.DataStore.AssignDdfSet(d.Id, set.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return api.writeDdfAssignments(c, d)
+}
+
+// GetDdfAssignments lists the functions assigned to a dataset
+func (api *ApiHandler) GetDdfAssignments(c echo.Context) error {
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	return api.writeDdfAssignments(c, d)
+}
+
+// DeleteDdfAssignment removes the function assigned to the occtype parameter
+// of a dataset, so the builtin functions are used for the occupancy type
+func (api *ApiHandler) DeleteDdfAssignment(c echo.Context) error {
+	_, err := api.requireAdmin(c)
+	if err != nil {
+		return err
+	}
+	occtype := strings.ToUpper(c.QueryParam("occtype"))
+	if occtype == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "occtype is required")
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	err = api.DataStore.DeleteDdfAssignment(d.Id, occtype)
+	if err != nil {
+		return err
+	}
+	return api.writeDdfAssignments(c, d)
+}
+
+func (api *ApiHandler) writeDdfAssignments(c echo.Context, d models.Dataset) error {
+	assignments, err := api.DataStore.GetDdfAssignments(d.Id)
+	if err != nil {
+		return err
+	}
+	result := make([]ddfAssignment, len(assignments))
+	for i, a := range assignments {
+		result[i] = ddfAssignment{Occtype: a.Occtype, DdfId: a.DdfId, SetId: a.SetId, Name: a.Name}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// datasetFunctions returns the builtin depth damage functions with the
+// catalog functions assigned to the dataset
+func (api *ApiHandler) datasetFunctions(d models.Dataset) (consequences.FunctionSet, error) {
+	ddfs, err := api.DataStore.GetDatasetDdfs(d.Id)
+	if err != nil {
+		return nil, err
+	}
+	return consequences.BuiltinFunctions.WithCatalog(ddfs), nil
+}
+
+func (api *ApiHandler) ddfSet(c echo.Context) (models.DdfSet, error) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return models.DdfSet{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid function set id: %s", c.Param("id")))
+	}
+	set, err := api.DataStore.GetDdfSet(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && set.Id == uuid.Nil) {
+		return set, echo.NewHTTPError(http.StatusNotFound, "function set not found")
+	}
+	return set, err
+}
+
+// readFunctionSet reads a function set document, named defaultName when the
+// document has no name
+func (api *ApiHandler) readFunctionSet(c echo.Context, defaultName string) (consequences.FunctionSetDocument, error) {
+	var doc consequences.FunctionSetDocument
+	maxBytes := api.Config.UploadMaxMB * 1024 * 1024
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxBytes+1))
+	if err != nil {
+		return doc, err
+	}
+	if int64(len(body)) > maxBytes {
+		return doc, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("function set exceeds the %d MB limit", api.Config.UploadMaxMB))
+	}
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+		doc.Name = c.QueryParam("name")
+		doc.Version = c.QueryParam("version")
+		doc.Description = c.QueryParam("description")
+		doc.Functions, err = consequences.ReadFunctionsCsv(bytes.NewReader(body))
+	} else {
+		err = json.Unmarshal(body, &doc)
+	}
+	if doc.Name == "" {
+		doc.Name = defaultName
+	}
+	if err == nil {
+		err = doc.Validate()
+	}
+	if err != nil {
+		return doc, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return doc, nil
+}
+
+func functionModels(functions []consequences.DepthDamageFunction) []models.Ddf {
+	ddfs := make([]models.Ddf, len(functions))
+	for i, f := range functions {
+		ddfs[i] = f.Model()
+	}
+	return ddfs
+}
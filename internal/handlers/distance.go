@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+// nearCandidates is the number of features nearest a structure by the index
+// that are compared by geodesic distance
+const nearCandidates = 5
+
+// nearFeaturesSetup loads the uploaded features into a temporary table.  Long
+// lines and large polygons are subdivided so the spatial index stays
+// selective and distances are computed on small pieces.
+var nearFeaturesSetup = []string{
+	`create temp table near_features (feature integer, geom geometry) on commit drop`,
+	`insert into near_features select (d).path[1], st_subdivide((d).geom,256)
+		from (select st_dump(st_geomfromwkb($1,4326)) as d) s`,
+	`create index on near_features using gist (geom)`,
+	`analyze near_features`,
+}
+
+// distanceRequest finds the nearest feature of an uploaded line or polygon
+// layer, such as stream centerlines or levees, to each structure
+type distanceRequest struct {
+	Features *gis.FeatureSet
+	Fields   []gis.Field // feature attributes carried onto the structures
+	Units    string
+	ToMeters float64
+	Sql      string
+	Params   []interface{}
+}
+
+type distanceRecord struct {
+	stores.Nsi
+	Feature  int64   `db:"near_feature"`
+	Distance float64 `db:"near_distance"`
+}
+
+// StructureDistances adds the distance to the nearest feature of an uploaded
+// line or polygon layer to the structures selected by the query parameters.
+// The id of the feature is its fid in the upload and the attributes
+// parameter lists feature attributes to add.  Distances are in
+// distance_units, which may be m, ft, km or mi.  The structures must be
+// limited to an area of interest with bbox, geometry or fips, otherwise the
+// area of interest is the extent of the features expanded by max_distance,
+// in distance_units.  Without a format the structures are streamed as
+// geojson, otherwise a job exports them.
+func (api *ApiHandler) StructureDistances(c echo.Context) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	var exportFormat gis.ExportFormat
+	if format != "" {
+		var ok bool
+		exportFormat, ok = gis.ExportFormats[format]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+		}
+	}
+	dr := distanceRequest{Units: strings.ToLower(c.QueryParam("distance_units"))}
+	var ok bool
+	dr.ToMeters, ok = bufferUnits[dr.Units]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid distance units: %s", dr.Units))
+	}
+	if dr.Units == "" {
+		dr.Units = "m"
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	geodataPost, err := api.openUpload(c)
+	if err != nil {
+		return err
+	}
+	names, fields, err := featureAttributes(c, geodataPost, false, "feature_id", "distance")
+	if err == nil {
+		dr.Fields = fields
+		dr.Features, err = geodataPost.ReadFeatureSet(names, 1)
+		err = uploadHTTPError(err)
+	}
+	geodataPost.Close()
+	if err != nil {
+		return err
+	}
+	var aoiCriteria []string
+	if c.QueryParam("bbox") == "" && c.QueryParam("geometry") == "" && c.QueryParam("fips") == "" {
+		maxDistance, err := strconv.ParseFloat(c.QueryParam("max_distance"), 64)
+		if err != nil || maxDistance <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				"an area of interest is required. Use bbox, geometry or fips, or max_distance from the features")
+		}
+		aoiCriteria = append(aoiCriteria, expandedExtent(dr.Features, maxDistance*dr.ToMeters))
+	}
+	criteria, params, err := getQueryCriteria(c, aoiCriteria...)
+	if err != nil {
+		return err
+	}
+	dr.Sql = nearestSql(d, criteria)
+	dr.Params = params
+	if api.Config.ExportMaxFeatures > 0 {
+		var count int64
+		err = api.DataStore.Db.Get(&count, fmt.Sprintf("select count(*) from %s %s", d.TableName, criteria), params...)
+		if err != nil {
+			return err
+		}
+		if count > api.Config.ExportMaxFeatures {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%d structures exceeds the maximum of %d", count, api.Config.ExportMaxFeatures))
+		}
+	}
+	if format == "" {
+		return api.streamDistances(c, &dr)
+	}
+	return api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		return api.writeDistances(&dr, localFile, exportFormat)
+	})
+}
+
+// expandedExtent selects the structures within the extent of the features
+// expanded by about meters.  Degrees of longitude are shortest at the
+// latitude furthest from the equator.
+func expandedExtent(fs *gis.FeatureSet, meters float64) string {
+	dy := meters / metersPerDegree
+	lat := math.Min(math.Max(math.Abs(fs.MinY), math.Abs(fs.MaxY))+dy, 89)
+	dx := dy / math.Cos(lat*math.Pi/180)
+	return fmt.Sprintf("st_intersects(shape,st_makeenvelope(%f,%f,%f,%f,4326))",
+		fs.MinX-dx, fs.MinY-dy, fs.MaxX+dx, fs.MaxY+dy)
+}
+
+// nearestSql selects the structures matching criteria with the nearest of
+// the index candidates by geodesic distance in meters
+func nearestSql(d models.Dataset, criteria string) string {
+	lateral := fmt.Sprintf(`,f.near_feature,f.near_distance FROM {table_name} n cross join lateral (
+		select c.feature as near_feature, st_distance(n.shape::geography,c.geom::geography) as near_distance
+		from (select feature, geom from near_features order by geom <-> n.shape limit %d) c
+		order by 2 limit 1) f`, nearCandidates)
+	selectSql := strings.Replace(stores.NsiSelect, "FROM {table_name}", lateral, 1)
+	return strings.ReplaceAll(fmt.Sprintf("%s %s", selectSql, criteria), "{table_name}", d.TableName)
+}
+
+// queryDistances loads the features in a transaction and queries the
+// structures.  Rolling back the transaction drops the features.
+func (api *ApiHandler) queryDistances(dr *distanceRequest) (*sqlx.Tx, *sqlx.Rows, error) {
+	tx, err := api.DataStore.Db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, stmt := range nearFeaturesSetup {
+		if i == 1 {
+			_, err = tx.Exec(stmt, dr.Features.Wkb)
+		} else {
+			_, err = tx.Exec(stmt)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	rows, err := tx.Queryx(dr.Sql, dr.Params...)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	return tx, rows, nil
+}
+
+// featureValues returns the feature id, distance and feature attributes of
+// a structure
+func (dr *distanceRequest) featureValues(record *distanceRecord) []interface{} {
+	values := []interface{}{dr.Features.Fids[record.Feature-1], record.Distance / dr.ToMeters}
+	return append(values, dr.Features.Values[record.Feature-1]...)
+}
+
+func (dr *distanceRequest) fieldNames() []string {
+	names := []string{"feature_id", "distance"}
+	for _, field := range dr.Fields {
+		names = append(names, field.Name)
+	}
+	return names
+}
+
+func (api *ApiHandler) streamDistances(c echo.Context, dr *distanceRequest) error {
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	tx, rows, err := api.queryDistances(dr)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	defer rows.Close()
+	names := dr.fieldNames()
+	writeCollectionStart(c, out, nil)
+	c.Response().Write(arrayStart)
+	record := distanceRecord{}
+	for i := 0; rows.Next(); i++ {
+		err = rows.StructScan(&record)
+		if err != nil {
+			return err
+		}
+		props, err := json.Marshal(&record.Nsi)
+		if err != nil {
+			return err
+		}
+		props = out.properties(&record.Nsi, props)
+		var builder bytes.Buffer
+		builder.Write(props[:len(props)-1])
+		for f, value := range dr.featureValues(&record) {
+			v, _ := json.Marshal(value)
+			builder.WriteString(fmt.Sprintf(`,"%s":%s`, names[f], v))
+		}
+		builder.WriteString("}")
+		if i > 0 {
+			c.Response().Write(featureSeparator)
+		}
+		x, y := out.Point(record.Point())
+		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, x, y)))
+		c.Response().Write(builder.Bytes())
+		c.Response().Write(featureEnd)
+	}
+	c.Response().Write(arrayEnd)
+	c.Response().Write(featureEnd)
+	c.Response().Flush()
+	return rows.Err()
+}
+
+func (api *ApiHandler) writeDistances(dr *distanceRequest, localFile string, format gis.ExportFormat) (int, interface{}, error) {
+	fields := append(nsiPointFields(),
+		gis.Field{Name: "feature_id", Type: ogr.FT_Integer64},
+		gis.Field{Name: "distance", Type: ogr.FT_Real},
+	)
+	writer, err := gis.NewPointWriter(localFile, format, "nsi_distance", append(fields, dr.Fields...))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer writer.Close()
+	tx, rows, err := api.queryDistances(dr)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	defer rows.Close()
+	record := distanceRecord{}
+	count := 0
+	for rows.Next() {
+		err = rows.StructScan(&record)
+		if err != nil {
+			return count, nil, err
+		}
+		err = writer.Write(record.X, record.Y, append(nsiValues(&record.Nsi), dr.featureValues(&record)...))
+		if err != nil {
+			return count, nil, err
+		}
+		count++
+	}
+	return count, nil, rows.Err()
+}
@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+)
+
+const cacheHeader = "X-NSI-Cache"
+
+// exportRequest is the normalized form of an export.  Two requests with
+// the same key select the same rows into the same output.
+type exportRequest struct {
+	Dataset    models.Dataset
+	Aoi        []byte          // wkb or wkt of the area of interest
+	AoiGeojson json.RawMessage // effective area of interest of buffered uploads
+	Criteria   string
+	Params     []interface{}
+	Fields     []string
+	Format     string
+	Srid       int    // output crs, the x and y fields remain in EPSG:4326
+	Layout     string // consequence tool layout replacing the nsi fields
+	Ffe        *gis.FfeOptions
+}
+
+func (er *exportRequest) Key() string {
+	aoiHash := sha256.Sum256(er.Aoi)
+	h := sha256.New()
+	fmt.Fprintf(h, "dataset=%s\n", er.Dataset.Id)
+	fmt.Fprintf(h, "aoi=%x\n", aoiHash)
+	fmt.Fprintf(h, "criteria=%s\n", er.Criteria)
+	fmt.Fprintf(h, "params=%v\n", er.Params)
+	fmt.Fprintf(h, "fields=%s\n", strings.Join(er.Fields, ","))
+	fmt.Fprintf(h, "format=%s\n", er.Format)
+	fmt.Fprintf(h, "srid=%d\n", er.Srid)
+	fmt.Fprintf(h, "layout=%s\n", er.Layout)
+	if er.Ffe != nil {
+		fmt.Fprintf(h, "ffe=%s,%t\n", er.Ffe.Datum, er.Ffe.Meters)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (er *exportRequest) CountSql() string {
+	return fmt.Sprintf("select count(*) from %s %s", er.Dataset.TableName, er.Criteria)
+}
+
+func (er *exportRequest) Sql() string {
+	fields := append([]string{"fd_id"}, er.Fields...)
+	if layout, ok := gis.Layouts[er.Layout]; ok {
+		fields = []string{layout.Columns()}
+	}
+	if er.Ffe != nil {
+		// converted to the requested datum and units during the export
+		fields = append(fields, "ground_elv+found_ht as ffe")
+	}
+	if er.Srid == 4326 {
+		fields = append(fields, "shape")
+	} else {
+		fields = append(fields, fmt.Sprintf("st_transform(shape,%d) as shape", er.Srid))
+	}
+	sql := fmt.Sprintf("select %s from %s %s", strings.Join(fields, ","), er.Dataset.TableName, er.Criteria)
+	return inlineParams(sql, er.Params)
+}
+
+func (api *ApiHandler) newExportRequest(c echo.Context) (*exportRequest, error) {
+	d, err := api.getDataset(c)
+	if err != nil {
+		return nil, err
+	}
+	format := strings.ToLower(c.QueryParam("format"))
+	layoutName := strings.ToLower(c.QueryParam("layout"))
+	layout, hasLayout := gis.Layouts[layoutName]
+	if layoutName != "" && !hasLayout {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid export layout: %s", layoutName))
+	}
+	if format == "" {
+		format = "gpkg"
+		if hasLayout {
+			format = layout.DefaultFormat
+		}
+	}
+	if _, ok := gis.ExportFormats[format]; !ok {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid export format: %s", format))
+	}
+	srid, err := getOutputSrid(c)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := parseFields(c.QueryParam("fields"))
+	if err != nil {
+		return nil, err
+	}
+	if hasLayout {
+		if c.QueryParam("fields") != "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "fields cannot be selected for a layout export")
+		}
+		err = layout.ValidateFormat(format)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		fields = layout.FieldNames()
+	}
+	ffe, err := getFfeConverter(c, srid)
+	if err != nil {
+		return nil, err
+	}
+	if ffe != nil {
+		ffe.Close()
+		if hasLayout {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "ffe cannot be added to a layout export")
+		}
+	}
+	er := exportRequest{
+		Dataset: d,
+		Fields:  fields,
+		Format:  format,
+		Srid:    srid,
+		Layout:  layoutName,
+	}
+	if ffe != nil {
+		er.Ffe = &gis.FfeOptions{Datum: ffe.Datum, Meters: ffe.Meters}
+	}
+	return &er, nil
+}
+
+// parseFields validates a comma separated field list and returns it in
+// inventory column order so equivalent lists normalize to the same value
+func parseFields(fieldList string) ([]string, error) {
+	var fields []string
+	if fieldList == "" {
+		for _, f := range stores.NsiFields {
+			if f != "fd_id" {
+				fields = append(fields, f)
+			}
+		}
+		return fields, nil
+	}
+	requested := map[string]bool{}
+	for _, f := range strings.Split(fieldList, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if !containsString(stores.NsiFields, f) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid field: %s", f))
+		}
+		requested[f] = true
+	}
+	for _, f := range stores.NsiFields {
+		if requested[f] && f != "fd_id" {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+type exportEstimate struct {
+	Dataset        string           `json:"dataset"`
+	Version        string           `json:"version"`
+	FeatureCount   int64            `json:"feature_count"`
+	Fields         []string         `json:"fields"`
+	Format         string           `json:"format"`
+	EstimatedBytes map[string]int64 `json:"estimated_bytes"`
+	Aoi            json.RawMessage  `json:"aoi,omitempty"`
+}
+
+func (api *ApiHandler) estimateExport(er *exportRequest) (*exportEstimate, error) {
+	var count int64
+	err := api.DataStore.Db.Get(&count, er.CountSql(), er.Params...)
+	if err != nil {
+		return nil, err
+	}
+	estimate := exportEstimate{
+		Dataset:        er.Dataset.Name,
+		Version:        er.Dataset.Version,
+		FeatureCount:   count,
+		Fields:         er.Fields,
+		Format:         er.Format,
+		EstimatedBytes: map[string]int64{},
+		Aoi:            er.AoiGeojson,
+	}
+	for name, format := range gis.ExportFormats {
+		estimate.EstimatedBytes[name] = format.EstimateSize(count, len(er.Fields))
+	}
+	return &estimate, nil
+}
+
+func (api *ApiHandler) checkExportLimits(estimate *exportEstimate) error {
+	maxFeatures := api.Config.ExportMaxFeatures
+	if maxFeatures > 0 && estimate.FeatureCount > maxFeatures {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("export matches %d structures, the maximum is %d", estimate.FeatureCount, maxFeatures))
+	}
+	maxBytes := api.Config.ExportMaxMB * 1024 * 1024
+	size := estimate.EstimatedBytes[estimate.Format]
+	if maxBytes > 0 && size > maxBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("estimated %s export size of %d MB exceeds the maximum of %d MB", estimate.Format, size/1024/1024, api.Config.ExportMaxMB))
+	}
+	return nil
+}
+
+// submitExport returns the id of an identical in-flight or retained export
+// when one exists, otherwise a new export job is started.  With dryrun=true
+// only the export estimate is returned.
+func (api *ApiHandler) submitExport(c echo.Context, er *exportRequest) error {
+	dryrun := c.QueryParam("dryrun") == "true"
+	if dryrun || api.Config.ExportMaxFeatures > 0 || api.Config.ExportMaxMB > 0 {
+		estimate, err := api.estimateExport(er)
+		if err != nil {
+			return err
+		}
+		err = api.checkExportLimits(estimate)
+		if err != nil {
+			return err
+		}
+		if dryrun {
+			return c.JSON(http.StatusOK, estimate)
+		}
+	}
+	callbacks, err := api.exportCallbacks(c)
+	if err != nil {
+		return err
+	}
+	key := er.Key()
+	for {
+		current, reused, err := api.reusableExport(key, callbacks)
+		if err != nil {
+			return err
+		}
+		if reused {
+			c.Response().Header().Set(cacheHeader, "HIT")
+			return c.String(http.StatusOK, current)
+		}
+		etl := api.newExportEtl(er)
+		started, err := api.TempStore.SwapExportJob(key, current, etl.Guid, func(job *stores.Job) {
+			job.Status = "Initialized"
+			job.Format = er.Format
+			job.Aoi = er.AoiGeojson
+			job.Location = fmt.Sprintf("%s/export/%s", baseUrl(c), etl.Guid)
+			job.Callbacks = callbacks
+		})
+		if err != nil {
+			return err
+		}
+		if started {
+			go api.runExport(etl)
+			c.Response().Header().Set(cacheHeader, "MISS")
+			return c.String(http.StatusOK, etl.Guid)
+		}
+		// an identical request started an export first, try to reuse it
+	}
+}
+
+// reusableExport returns the guid the export key points to and whether that
+// job is in flight or retained and is reused.  Callbacks are added to an
+// in-flight job and notified at once for a retained job.  Retention runs from
+// the completion of the job.
+func (api *ApiHandler) reusableExport(key string, callbacks []stores.Callback) (string, bool, error) {
+	guid, err := api.TempStore.GetExportJob(key)
+	if err != nil || guid == "" {
+		return guid, false, err
+	}
+	job, err := api.TempStore.GetJob(guid)
+	if err != nil || job == nil {
+		return guid, false, err
+	}
+	switch job.Status {
+	case "Initialized", "Processing":
+		inFlight := false
+		err = api.TempStore.UpdateJob(guid, func(job *stores.Job) {
+			inFlight = job.Status == "Initialized" || job.Status == "Processing"
+			if inFlight {
+				job.Callbacks = append(job.Callbacks, callbacks...)
+			}
+		})
+		if err != nil || inFlight {
+			return guid, inFlight, err
+		}
+		// the job finished since it was read
+		return api.reusableExport(key, callbacks)
+	case "Completed":
+		if job.Completed == nil || time.Since(*job.Completed) > api.Config.ExportRetention {
+			return guid, false, nil
+		}
+		exists, err := api.FileStore.Exists(api.exportKey(guid, job.Format))
+		if err != nil || !exists {
+			return guid, false, err
+		}
+		if len(callbacks) > 0 {
+			go api.Webhooks.NotifyCallbacks(api.TempStore, job, callbacks)
+		}
+		return guid, true, nil
+	}
+	return guid, false, nil
+}
+
+func (api *ApiHandler) newExportEtl(er *exportRequest) *gis.Db2FileEtl {
+	uuid, _ := uuid.NewUUID()
+	name := uuid.String()
+	format := gis.ExportFormats[er.Format]
+	var layout *gis.Layout
+	if l, ok := gis.Layouts[er.Layout]; ok {
+		layout = &l
+	}
+	fileOut := name + "." + format.Extension
+	if format.Zip {
+		fileOut = name
+	}
+	return &gis.Db2FileEtl{
+		DbDriver:     "PostgreSQL",
+		UrlTemplate:  "PG: host=%s dbname=%s user=%s password=%s",
+		DbDialect:    "POSTGRESQL",
+		DbOptions:    format.LayerOptions,
+		User:         api.Config.Dbuser,
+		Pass:         api.Config.Dbpass,
+		Host:         api.Config.Dbhost,
+		Db:           api.Config.Dbname,
+		Sql:          er.Sql(),
+		FileDriver:   format.Driver,
+		NewLayerName: "nsi_export",
+		FileOut:      fileOut,
+		Guid:         name,
+		StoreKey:     api.exportKey(name, er.Format),
+		ZipOutput:    format.Zip,
+		Srid:         er.Srid,
+		Layout:       layout,
+		Ffe:          er.Ffe,
+	}
+}
+
+func (api *ApiHandler) runExport(etl *gis.Db2FileEtl) {
+	gis.RunDb2FileEtl(etl, api.TempStore, api.Config.TempStoragePath, api.FileStore, &gis.ConsoleReporter{})
+	api.Webhooks.NotifyJob(api.TempStore, etl.Guid)
+}
+
+// RemoveExpiredExports deletes the outputs of jobs completed more than the
+// export retention ago from the file store every interval.  The jobs are
+// marked Expired.
+func (api *ApiHandler) RemoveExpiredExports(interval time.Duration) {
+	for {
+		api.removeExpiredExports()
+		time.Sleep(interval)
+	}
+}
+
+func (api *ApiHandler) removeExpiredExports() {
+	jobs, err := api.TempStore.CompletedBefore(time.Now().Add(-api.Config.ExportRetention))
+	if err != nil {
+		log.Printf("Unable to find expired exports: %s\n", err)
+		return
+	}
+	for _, job := range jobs {
+		err = api.FileStore.Delete(api.exportKey(job.Id, job.Format))
+		if err != nil {
+			log.Printf("Unable to delete expired export %s: %s\n", job.Id, err)
+			continue
+		}
+		err = api.TempStore.PutStatus(job.Id, "Expired")
+		if err != nil {
+			log.Printf("Unable to expire job %s: %s\n", job.Id, err)
+		}
+	}
+}
+
+func (api *ApiHandler) exportKey(name string, format string) string {
+	if format == "" {
+		format = "gpkg"
+	}
+	return fmt.Sprintf("%s%s.%s", api.Config.ExportPrefix, name, gis.ExportFormats[format].Extension)
+}
+
+func containsString(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/utils"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+const maxHazardRasters = 10
+
+var invalidColumnChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// hazardRaster is an uploaded raster sampled into the named column
+type hazardRaster struct {
+	Name string
+	Path string
+}
+
+// hazardRequest holds the validated parameters of a hazard sampling request
+type hazardRequest struct {
+	Rasters []hazardRaster
+	// SkipNoData drops structures without a value in any raster, otherwise
+	// missing values are written as FillValue or null
+	SkipNoData bool
+	FillValue  *float64
+	Sql        string
+	Params     []interface{}
+}
+
+// SampleHazards attaches the values of one or more uploaded hazard rasters,
+// such as depth, velocity, arrival time or wind speed, to the structures
+// they cover.  The structures can be limited to an area of interest layer
+// uploaded in the file form field or given by the geometry parameter, within
+// the extent of the rasters.  Without a format the structures are streamed
+// as geojson, otherwise a job writes them in the export format.
+func (api *ApiHandler) SampleHazards(c echo.Context) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	var exportFormat gis.ExportFormat
+	if format != "" {
+		var ok bool
+		exportFormat, ok = gis.ExportFormats[format]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+		}
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	hr, err := api.newHazardRequest(c)
+	if err != nil {
+		return err
+	}
+	aoiCriteria, err := api.hazardAoi(c)
+	if err != nil {
+		hr.removeRasters()
+		return err
+	}
+	grids, err := hr.openGrids()
+	if err != nil {
+		hr.removeRasters()
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, grid := range grids {
+		gMinX, gMinY, gMaxX, gMaxY := grid.Bounds()
+		minX, minY = math.Min(minX, gMinX), math.Min(minY, gMinY)
+		maxX, maxY = math.Max(maxX, gMaxX), math.Max(maxY, gMaxY)
+	}
+	criteria, params, err := getQueryCriteria(c, fmt.Sprintf("st_intersects(shape,st_makeenvelope(%f,%f,%f,%f,4326))", minX, minY, maxX, maxY), aoiCriteria)
+	if err != nil {
+		closeGrids(grids)
+		hr.removeRasters()
+		return err
+	}
+	hr.Sql = strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName)
+	hr.Params = params
+	if format == "" {
+		defer hr.removeRasters()
+		defer closeGrids(grids)
+		return api.streamHazards(c, hr, grids)
+	}
+	closeGrids(grids)
+	err = api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		defer hr.removeRasters()
+		return api.writeHazards(hr, localFile, exportFormat)
+	})
+	if err != nil {
+		hr.removeRasters()
+	}
+	return err
+}
+
+func (api *ApiHandler) newHazardRequest(c echo.Context) (*hazardRequest, error) {
+	hr := hazardRequest{}
+	switch nodata := strings.ToLower(c.QueryParam("nodata")); nodata {
+	case "", "null":
+	case "skip":
+		hr.SkipNoData = true
+	default:
+		fill, err := strconv.ParseFloat(nodata, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "nodata must be null, skip or a fill value")
+		}
+		hr.FillValue = &fill
+	}
+	api.limitUpload(c)
+	form, err := c.MultipartForm()
+	if api.isUploadTooLarge(err) {
+		return nil, api.uploadTooLargeError()
+	}
+	if err != nil || len(form.File["raster"]) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "at least one raster file upload is required")
+	}
+	files := form.File["raster"]
+	if len(files) > maxHazardRasters {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d rasters can be sampled", maxHazardRasters))
+	}
+	var names []string
+	if nameList := c.FormValue("names"); nameList != "" {
+		names = strings.Split(nameList, ",")
+		if len(names) != len(files) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "names must give a column name for every raster")
+		}
+	}
+	columns := map[string]bool{"ffe": true}
+	for _, field := range stores.NsiFields {
+		columns[field] = true
+	}
+	maxBytes := api.Config.UploadMaxMB * 1024 * 1024
+	for i, file := range files {
+		name := strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))
+		if names != nil {
+			name = names[i]
+		}
+		name = strings.Trim(invalidColumnChars.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "_"), "_")
+		if name == "" || columns[name] {
+			hr.removeRasters()
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid or duplicate raster column name: %s", name))
+		}
+		columns[name] = true
+		if file.Size > maxBytes {
+			hr.removeRasters()
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the maximum size of %d MB", api.Config.UploadMaxMB))
+		}
+		uuid, _ := uuid.NewUUID()
+		path, err := utils.CopyPostFileToTemp(api.Config.TempStoragePath, uuid.String(), file)
+		if err != nil {
+			hr.removeRasters()
+			return nil, err
+		}
+		hr.Rasters = append(hr.Rasters, hazardRaster{Name: name, Path: path})
+	}
+	return &hr, nil
+}
+
+// hazardAoi returns the criteria selecting the structures in an area of
+// interest uploaded with the rasters, or no criteria without one
+func (api *ApiHandler) hazardAoi(c echo.Context) (string, error) {
+	if _, err := c.FormFile("file"); err != nil {
+		return "", nil
+	}
+	geodataPost, err := api.openUpload(c)
+	if err != nil {
+		return "", err
+	}
+	defer geodataPost.Close()
+	criteria, _, err := uploadAoi(geodataPost)
+	return criteria, err
+}
+
+func (hr *hazardRequest) openGrids() ([]*gis.Grid, error) {
+	grids := make([]*gis.Grid, 0, len(hr.Rasters))
+	for _, raster := range hr.Rasters {
+		grid, err := gis.OpenGrid(raster.Path)
+		if err != nil {
+			closeGrids(grids)
+			return nil, fmt.Errorf("%s: %s", raster.Name, err)
+		}
+		grids = append(grids, grid)
+	}
+	return grids, nil
+}
+
+func (hr *hazardRequest) removeRasters() {
+	for _, raster := range hr.Rasters {
+		os.RemoveAll(filepath.Dir(raster.Path))
+	}
+}
+
+// sample returns the value of every grid at a structure and false when the
+// structure should be skipped.  Missing values are nil unless filled.
+func (hr *hazardRequest) sample(grids []*gis.Grid, nsi *stores.Nsi) ([]interface{}, bool) {
+	values := make([]interface{}, len(grids))
+	found := false
+	for i, grid := range grids {
+		if v, ok := grid.Sample(nsi.X, nsi.Y); ok {
+			values[i] = v
+			found = true
+		} else if hr.FillValue != nil {
+			values[i] = *hr.FillValue
+		}
+	}
+	return values, found || !hr.SkipNoData
+}
+
+func closeGrids(grids []*gis.Grid) {
+	for _, grid := range grids {
+		grid.Close()
+	}
+}
+
+func (api *ApiHandler) streamHazards(c echo.Context, hr *hazardRequest, grids []*gis.Grid) error {
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	rows, err := api.DataStore.Db.Queryx(hr.Sql, hr.Params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	writeCollectionStart(c, out, nil)
+	c.Response().Write(arrayStart)
+	nsi := stores.Nsi{}
+	for i := 0; rows.Next(); {
+		err = rows.StructScan(&nsi)
+		if err != nil {
+			return err
+		}
+		values, ok := hr.sample(grids, &nsi)
+		if !ok {
+			continue
+		}
+		props, err := json.Marshal(&nsi)
+		if err != nil {
+			return err
+		}
+		props = out.properties(&nsi, props)
+		var builder bytes.Buffer
+		builder.Write(props[:len(props)-1])
+		for r, raster := range hr.Rasters {
+			value, _ := json.Marshal(values[r])
+			builder.WriteString(fmt.Sprintf(`,"%s":%s`, raster.Name, value))
+		}
+		builder.WriteString("}")
+		if i > 0 {
+			c.Response().Write(featureSeparator)
+		}
+		x, y := out.Point(nsi.Point())
+		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, x, y)))
+		c.Response().Write(builder.Bytes())
+		c.Response().Write(featureEnd)
+		i++
+	}
+	c.Response().Write(arrayEnd)
+	c.Response().Write(featureEnd)
+	c.Response().Flush()
+	return rows.Err()
+}
+
+func (api *ApiHandler) writeHazards(hr *hazardRequest, localFile string, format gis.ExportFormat) (int, interface{}, error) {
+	grids, err := hr.openGrids()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer closeGrids(grids)
+	fields := nsiPointFields()
+	for _, raster := range hr.Rasters {
+		fields = append(fields, gis.Field{Name: raster.Name, Type: ogr.FT_Real})
+	}
+	writer, err := gis.NewPointWriter(localFile, format, "nsi_hazards", fields)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer writer.Close()
+	rows, err := api.DataStore.Db.Queryx(hr.Sql, hr.Params...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	nsi := stores.Nsi{}
+	count := 0
+	for rows.Next() {
+		err = rows.StructScan(&nsi)
+		if err != nil {
+			return count, nil, err
+		}
+		values, ok := hr.sample(grids, &nsi)
+		if !ok {
+			continue
+		}
+		err = writer.Write(nsi.X, nsi.Y, append(nsiValues(&nsi), values...))
+		if err != nil {
+			return count, nil, err
+		}
+		count++
+	}
+	return count, nil, rows.Err()
+}
+
+// nsiPointFields are the inventory attributes written by a PointWriter
+func nsiPointFields() []gis.Field {
+	t := reflect.TypeOf(stores.Nsi{})
+	fields := make([]gis.Field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fieldType := ogr.FT_String
+		switch t.Field(i).Type.Kind() {
+		case reflect.Int32:
+			fieldType = ogr.FT_Integer
+		case reflect.Float64:
+			fieldType = ogr.FT_Real
+		}
+		fields = append(fields, gis.Field{Name: t.Field(i).Tag.Get("db"), Type: fieldType})
+	}
+	return fields
+}
+
+// nsiValues are the inventory attributes in nsiPointFields order
+func nsiValues(nsi *stores.Nsi) []interface{} {
+	v := reflect.ValueOf(nsi).Elem()
+	values := make([]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		values[i] = v.Field(i).Interface()
+	}
+	return values
+}
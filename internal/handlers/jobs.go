@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/utils"
+	"github.com/labstack/echo"
+)
+
+// jobWork writes the output of a background job to localFile and returns
+// the number of features written and an optional summary recorded on the job
+type jobWork func(localFile string) (int, interface{}, error)
+
+// jobStatus is the state of a job returned to any holder of its id.  The
+// callbacks and webhook deliveries of a job are only listed for their owner,
+// since an export can be shared by several users.
+type jobStatus struct {
+	stores.Job
+	Callbacks  []stores.Callback `json:"callbacks,omitempty"`
+	Deliveries []stores.Delivery `json:"deliveries,omitempty"`
+}
+
+func newJobStatus(job *stores.Job, userId string) jobStatus {
+	status := jobStatus{Job: *job}
+	if userId == "" {
+		return status
+	}
+	for _, callback := range job.Callbacks {
+		if callback.Owner == userId {
+			status.Callbacks = append(status.Callbacks, callback)
+		}
+	}
+	for _, delivery := range job.Deliveries {
+		if delivery.Owner == userId {
+			status.Deliveries = append(status.Deliveries, delivery)
+		}
+	}
+	return status
+}
+
+// startJob records a new job and runs work in the background.  The output is
+// moved to the file store and downloaded the same way as an export.  work
+// owns the resources it uses once the job starts, so startJob only returns
+// an error when the job was not started and the caller must release them.
+func (api *ApiHandler) startJob(c echo.Context, format string, work jobWork) error {
+	uuid, _ := uuid.NewUUID()
+	guid := uuid.String()
+	callbacks, err := api.exportCallbacks(c)
+	if err != nil {
+		return err
+	}
+	err = api.TempStore.UpdateJob(guid, func(job *stores.Job) {
+		job.Status = "Initialized"
+		job.Format = format
+		job.Location = fmt.Sprintf("%s/export/%s", baseUrl(c), guid)
+		job.Callbacks = callbacks
+	})
+	if err != nil {
+		return err
+	}
+	go api.runJob(guid, format, work)
+	c.String(http.StatusOK, guid)
+	return nil
+}
+
+func (api *ApiHandler) runJob(guid string, format string, work jobWork) {
+	api.TempStore.PutStatus(guid, "Processing")
+	count, summary, err := api.runJobWork(guid, format, work)
+	var summaryJson []byte
+	if err == nil && summary != nil {
+		summaryJson, err = json.Marshal(summary)
+	}
+	if err != nil {
+		log.Printf("Job %s failed: %s\n", guid, err)
+	}
+	api.TempStore.UpdateJob(guid, func(job *stores.Job) {
+		if err != nil {
+			job.Status = "Failed"
+			job.Error = err.Error()
+		} else {
+			job.Status = "Completed"
+			job.FeatureCount = count
+			job.Summary = summaryJson
+		}
+	})
+	api.Webhooks.NotifyJob(api.TempStore, guid)
+}
+
+func (api *ApiHandler) runJobWork(guid string, format string, work jobWork) (count int, summary interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from %v", r)
+		}
+	}()
+	exportFormat := gis.ExportFormats[format]
+	localFile := api.Config.TempStoragePath + guid
+	if !exportFormat.Zip {
+		localFile += "." + exportFormat.Extension
+	}
+	defer os.RemoveAll(localFile)
+	count, summary, err = work(localFile)
+	if err != nil {
+		return count, summary, err
+	}
+	if exportFormat.Zip {
+		zipFile := localFile + ".zip"
+		defer os.Remove(zipFile)
+		err = utils.ZipDir(localFile, zipFile)
+		if err != nil {
+			return count, summary, err
+		}
+		localFile = zipFile
+	}
+	return count, summary, stores.PutFile(api.FileStore, api.exportKey(guid, format), localFile)
+}
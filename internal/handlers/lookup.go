@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+)
+
+// lookupBatchSize is the number of ids queried at a time
+const lookupBatchSize = 5000
+
+// LookupStructures streams the structures for a posted list of fd_ids as a
+// feature collection.  Ids that are not in the dataset are listed in the
+// not_found member of the collection.
+func (api *ApiHandler) LookupStructures(c echo.Context) error {
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	fdIds, err := api.parseFdIds(c)
+	if err != nil {
+		return err
+	}
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	sql := strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, "where fd_id = any(string_to_array($1,',')::int[])"), "{table_name}", d.TableName)
+	found := map[int32]bool{}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c.Response().WriteHeader(http.StatusOK)
+	writeCollectionStart(c, out, nil)
+	c.Response().Write(arrayStart)
+	for start := 0; start < len(fdIds); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(fdIds) {
+			end = len(fdIds)
+		}
+		err = api.writeLookupBatch(c, sql, fdIds[start:end], out, found)
+		if err != nil {
+			return err
+		}
+	}
+	notFound := []int32{}
+	for _, fdId := range fdIds {
+		if !found[fdId] {
+			notFound = append(notFound, fdId)
+		}
+	}
+	notFoundJson, err := json.Marshal(notFound)
+	if err != nil {
+		return err
+	}
+	c.Response().Write(arrayEnd)
+	c.Response().Write([]byte(`,"not_found":`))
+	c.Response().Write(notFoundJson)
+	c.Response().Write(featureEnd)
+	c.Response().Flush()
+	return nil
+}
+
+func (api *ApiHandler) writeLookupBatch(c echo.Context, sql string, fdIds []int32, out *outputCrs, found map[int32]bool) error {
+	ids := make([]string, len(fdIds))
+	for i, fdId := range fdIds {
+		ids[i] = strconv.Itoa(int(fdId))
+	}
+	rows, err := api.DataStore.Db.Queryx(sql, strings.Join(ids, ","))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	nsi := stores.Nsi{}
+	for rows.Next() {
+		err := rows.StructScan(&nsi)
+		if err != nil {
+			log.Printf("Unable to map query to NSI Struct. Msg: %s\n", err)
+			return err
+		}
+		props, err := json.Marshal(nsi)
+		if err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			c.Response().Write(featureSeparator)
+		}
+		found[nsi.Fd_id] = true
+		props = out.properties(&nsi, props)
+		x, y := out.Point(nsi.X, nsi.Y)
+		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, x, y)))
+		c.Response().Write(props)
+		c.Response().Write(featureEnd)
+	}
+	return rows.Err()
+}
+
+// parseFdIds reads the fd_ids posted as a json array or as csv.  A csv header
+// row is skipped and only the first column of each row is read.  Duplicate
+// ids are removed.
+func (api *ApiHandler) parseFdIds(c echo.Context) ([]int32, error) {
+	maxBytes := api.Config.UploadMaxMB * 1024 * 1024
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Lookup exceeds the maximum size of %d MB", api.Config.UploadMaxMB))
+	}
+	body = bytes.TrimSpace(body)
+	var values []string
+	if bytes.HasPrefix(body, []byte("[")) {
+		var ids []json.Number
+		err = json.Unmarshal(body, &ids)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid fd_id array: %s", err))
+		}
+		for _, id := range ids {
+			values = append(values, id.String())
+		}
+	} else {
+		reader := csv.NewReader(bytes.NewReader(body))
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid fd_id csv: %s", err))
+		}
+		for i, record := range records {
+			value := strings.TrimSpace(record[0])
+			if i == 0 && !isDigits(value) {
+				continue
+			}
+			values = append(values, value)
+		}
+	}
+	fdIds := []int32{}
+	seen := map[int32]bool{}
+	for _, value := range values {
+		fdId, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid fd_id: %s", value))
+		}
+		if !seen[int32(fdId)] {
+			seen[int32(fdId)] = true
+			fdIds = append(fdIds, int32(fdId))
+		}
+	}
+	if len(fdIds) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "No fd_ids were given")
+	}
+	if len(fdIds) > api.Config.LookupMaxIds {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Lookup of %d fd_ids exceeds the maximum of %d", len(fdIds), api.Config.LookupMaxIds))
+	}
+	return fdIds, nil
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+)
+
+const maxNearest = 1000
+
+// metersPerDegree is the length of a degree of latitude, used to expand the
+// point into a bounding box the spatial index can search
+const metersPerDegree = 111320.0
+
+// GetNearStructures returns the structures within radius meters of lon/lat,
+// the k structures closest to lon/lat, or the k closest within the radius.
+// Features are ordered by distance and include their distance in meters.
+func (api *ApiHandler) GetNearStructures(c echo.Context) error {
+	apifmt := c.QueryParam("fmt")
+	if apifmt == "" {
+		apifmt = "fc"
+	}
+	lon, err := parseCoordinate(c, "lon", 180)
+	if err != nil {
+		return err
+	}
+	lat, err := parseCoordinate(c, "lat", 90)
+	if err != nil {
+		return err
+	}
+	radius, err := parseRadius(c)
+	if err != nil {
+		return err
+	}
+	k, err := parseNearest(c.QueryParam("k"))
+	if err != nil {
+		return err
+	}
+	if radius == 0 && k == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "a radius or k is required")
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	criteria, params, err := getQueryCriteria(c)
+	if err != nil {
+		return err
+	}
+	params = append(params, lon, lat)
+	point := fmt.Sprintf("st_setsrid(st_makepoint($%d,$%d),4326)", len(params)-1, len(params))
+	if radius > 0 {
+		params = append(params, radius)
+		criteria = buildCritieria(strings.TrimPrefix(criteria, "where "),
+			fmt.Sprintf("shape && st_expand(%s,%f)", point, expandDegrees(radius, lat)),
+			fmt.Sprintf("st_dwithin(shape::geography,%s::geography,$%d)", point, len(params)))
+	}
+	sql := fmt.Sprintf("%s %s order by distance", stores.NsiDistanceSelect, criteria)
+	if k > 0 {
+		//the knn operator orders candidates by the spatial index, the final
+		//order is by geodesic distance
+		sql = fmt.Sprintf("select * from (%s %s order by shape <-> %s limit %d) near order by distance",
+			stores.NsiDistanceSelect, criteria, point, k)
+	}
+	sql = strings.ReplaceAll(sql, "{point}", point)
+	sql = strings.ReplaceAll(sql, "{table_name}", d.TableName)
+	rows, err := api.DataStore.Db.Queryx(sql, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if apifmt == "fs" {
+		return rowsToGeojsonStream(c, rows, &stores.NsiDistance{}, out)
+	}
+	return rowsToGeojson(c, apifmt, rows, &stores.NsiDistance{}, out, nil)
+}
+
+func parseCoordinate(c echo.Context, name string, limit float64) (float64, error) {
+	value := c.QueryParam(name)
+	coord, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.Abs(coord) > limit {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid %s: %s", name, value))
+	}
+	return coord, nil
+}
+
+// parseRadius returns the radius parameter in meters.  Units are given by
+// radius_units the same as buffer distances.
+func parseRadius(c echo.Context) (float64, error) {
+	value := c.QueryParam("radius")
+	if value == "" {
+		return 0, nil
+	}
+	radius, err := strconv.ParseFloat(value, 64)
+	if err != nil || radius <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid radius: %s", value))
+	}
+	units := strings.ToLower(c.QueryParam("radius_units"))
+	toMeters, ok := bufferUnits[units]
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid radius units: %s", units))
+	}
+	return radius * toMeters, nil
+}
+
+func parseNearest(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	k, err := strconv.Atoi(value)
+	if err != nil || k <= 0 || k > maxNearest {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid k: %s. k must be between 1 and %d", value, maxNearest))
+	}
+	return k, nil
+}
+
+// expandDegrees converts a distance in meters to degrees of longitude at the
+// given latitude, which is never less than the distance in degrees of latitude
+func expandDegrees(meters float64, lat float64) float64 {
+	cosLat := math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	return meters / (metersPerDegree * cosLat)
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+// overlayRequest joins the polygons of an uploaded layer to the structures
+// they contain.  A structure in overlapping polygons takes the attributes of
+// the first polygon in the layer.
+type overlayRequest struct {
+	Zones *gis.FeatureSet
+	// Fields are the zone attributes carried onto the structures, named with
+	// the prefix parameter.  Zones.Fields can also hold the summary field.
+	Fields     []gis.Field
+	SummaryBy  string
+	Sql        string
+	SummarySql string
+	Params     []interface{}
+	// SummaryParams are Params with the summary values of the zones
+	SummaryParams []interface{}
+}
+
+type overlayRecord struct {
+	stores.Nsi
+	Zone sql.NullInt64 `db:"zone"`
+}
+
+// overlaySummary is the inventory summary of the structures in the zones
+// with the same summary_by value
+type overlaySummary struct {
+	Value string `db:"zone_value" json:"value"`
+	stores.NsiSummary
+}
+
+type overlaySummaries struct {
+	SummaryBy string           `json:"summary_by"`
+	Summaries []overlaySummary `json:"summaries"`
+}
+
+// OverlayStructures tags the structures within an uploaded polygon layer,
+// such as flood zones, levee protected areas or jurisdictions, with the
+// polygon attributes listed in the attributes parameter, defaulting to every
+// attribute.  keep_unmatched=true also returns the structures within the
+// extent of the layer that are outside every polygon.  summary_by returns the
+// inventory summary by the values of a polygon attribute.  Without a format
+// the structures, or the summaries, are returned directly, otherwise a job
+// exports the structures with the summaries in the job summary, and as a
+// table for formats with tables.
+func (api *ApiHandler) OverlayStructures(c echo.Context) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	var exportFormat gis.ExportFormat
+	if format != "" {
+		var ok bool
+		exportFormat, ok = gis.ExportFormats[format]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+		}
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	geodataPost, err := api.openUpload(c)
+	if err != nil {
+		return err
+	}
+	or, err := newOverlayRequest(c, geodataPost)
+	geodataPost.Close()
+	if err != nil {
+		return err
+	}
+	err = or.buildSql(c, d)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		if or.SummaryBy != "" {
+			summaries, err := api.overlaySummaries(or)
+			if err != nil {
+				return err
+			}
+			return c.JSON(http.StatusOK, summaries)
+		}
+		return api.streamOverlay(c, or)
+	}
+	return api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		writer, err := gis.NewPointWriter(localFile, exportFormat, "nsi_overlay", append(nsiPointFields(), or.Fields...))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer writer.Close()
+		count, err := api.writeOverlay(or, writer)
+		if err != nil || or.SummaryBy == "" {
+			return count, nil, err
+		}
+		summaries, err := api.overlaySummaries(or)
+		if err != nil {
+			return count, nil, err
+		}
+		if exportFormat.Tables {
+			err = writeOverlaySummaries(writer, summaries)
+			if err != nil {
+				return count, nil, fmt.Errorf("Unable to write overlay summaries: %s", err)
+			}
+		}
+		return count, summaries, nil
+	})
+}
+
+func newOverlayRequest(c echo.Context, geodataPost *gis.GeodataPost) (*overlayRequest, error) {
+	names, fields, err := featureAttributes(c, geodataPost, true)
+	if err != nil {
+		return nil, err
+	}
+	or := overlayRequest{Fields: fields, SummaryBy: c.QueryParam("summary_by")}
+	if or.SummaryBy != "" && !containsString(names, or.SummaryBy) {
+		names = append(names, or.SummaryBy)
+	}
+	or.Zones, err = geodataPost.ReadFeatureSet(names, 2)
+	if err != nil {
+		return nil, uploadHTTPError(err)
+	}
+	return &or, nil
+}
+
+// featureAttributes returns the uploaded layer attributes listed in the
+// attributes parameter, or every attribute when all is set, and their output
+// fields named with the prefix parameter.  Output fields cannot repeat the
+// inventory fields or reserved.
+func featureAttributes(c echo.Context, geodataPost *gis.GeodataPost, all bool, reserved ...string) ([]string, []gis.Field, error) {
+	layerFields, err := geodataPost.LayerFields()
+	if err != nil {
+		return nil, nil, uploadHTTPError(err)
+	}
+	fieldTypes := make(map[string]ogr.FieldType, len(layerFields))
+	var names []string
+	for _, field := range layerFields {
+		fieldTypes[field.Name] = field.Type
+		if all {
+			names = append(names, field.Name)
+		}
+	}
+	if attributes := c.QueryParam("attributes"); attributes != "" {
+		names = nil
+		for _, name := range strings.Split(attributes, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	prefix := c.QueryParam("prefix")
+	columns := map[string]bool{"ffe": true}
+	for _, column := range stores.NsiFields {
+		columns[column] = true
+	}
+	for _, column := range reserved {
+		columns[column] = true
+	}
+	fields := make([]gis.Field, len(names))
+	for i, name := range names {
+		fieldType, ok := fieldTypes[name]
+		if !ok {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Uploaded layer does not have a %s field", name))
+		}
+		column := prefix + name
+		if columns[column] {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("attribute %s is an inventory field or listed twice. Use the prefix parameter to rename the attributes", column))
+		}
+		columns[column] = true
+		fields[i] = gis.Field{Name: column, Type: fieldType}
+	}
+	return names, fields, nil
+}
+
+// buildSql selects the structures within the extent of the zones matching the
+// query parameters, with the first zone containing each structure
+func (or *overlayRequest) buildSql(c echo.Context, d models.Dataset) error {
+	z := or.Zones
+	criteria, params, err := getQueryCriteria(c, fmt.Sprintf("st_intersects(shape,st_makeenvelope(%f,%f,%f,%f,4326))", z.MinX, z.MinY, z.MaxX, z.MaxY))
+	if err != nil {
+		return err
+	}
+	params = append(params, z.Wkb)
+	with := fmt.Sprintf(`with zones as (select (d).path[1] as zone,(d).geom from (select st_dump(st_geomfromwkb($%d,4326)) as d) s),
+		matches as (select distinct on (n.fd_id) n.fd_id,z.zone from zones z join {table_name} n on st_intersects(n.shape,z.geom) order by n.fd_id,z.zone)`, len(params))
+	join := "join"
+	if c.QueryParam("keep_unmatched") == "true" {
+		join = "left join"
+	}
+	selectSql := strings.Replace(stores.NsiSelect, "FROM {table_name}", fmt.Sprintf(",m.zone FROM {table_name} %s matches m using (fd_id)", join), 1)
+	or.Sql = strings.ReplaceAll(fmt.Sprintf("%s %s %s", with, selectSql, criteria), "{table_name}", d.TableName)
+	or.Params = params
+	if or.SummaryBy == "" {
+		return nil
+	}
+	summaryIndex := len(z.Fields) - 1
+	for i, field := range z.Fields {
+		if field.Name == or.SummaryBy {
+			summaryIndex = i
+		}
+	}
+	values := make([]interface{}, len(z.Values))
+	for i, zoneValues := range z.Values {
+		values[i] = zoneValues[summaryIndex]
+	}
+	valuesJson, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	or.SummaryParams = append(append([]interface{}{}, params...), string(valuesJson))
+	statsSql := strings.Replace(stores.NsiStatsSelect, "select",
+		fmt.Sprintf("select coalesce(($%d::jsonb)->>(m.zone-1),'') as zone_value,", len(or.SummaryParams)), 1)
+	statsSql = strings.Replace(statsSql, "from {table_name}", "from {table_name} join matches m using (fd_id)", 1)
+	or.SummarySql = strings.ReplaceAll(fmt.Sprintf("%s %s %s group by 1 order by 1", with, statsSql, criteria), "{table_name}", d.TableName)
+	return nil
+}
+
+// zoneValues returns the carried attributes of the zone of a structure, or
+// nils when the structure is outside every zone
+func (or *overlayRequest) zoneValues(record *overlayRecord) []interface{} {
+	if !record.Zone.Valid {
+		return make([]interface{}, len(or.Fields))
+	}
+	return or.Zones.Values[record.Zone.Int64-1][:len(or.Fields)]
+}
+
+func (api *ApiHandler) overlaySummaries(or *overlayRequest) (*overlaySummaries, error) {
+	summaries := overlaySummaries{SummaryBy: or.SummaryBy, Summaries: []overlaySummary{}}
+	err := api.DataStore.Db.Select(&summaries.Summaries, or.SummarySql, or.SummaryParams...)
+	return &summaries, err
+}
+
+func (api *ApiHandler) streamOverlay(c echo.Context, or *overlayRequest) error {
+	out, err := newOutputCrs(c)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	rows, err := api.DataStore.Db.Queryx(or.Sql, or.Params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	writeCollectionStart(c, out, nil)
+	c.Response().Write(arrayStart)
+	record := overlayRecord{}
+	for i := 0; rows.Next(); i++ {
+		err = rows.StructScan(&record)
+		if err != nil {
+			return err
+		}
+		props, err := json.Marshal(&record.Nsi)
+		if err != nil {
+			return err
+		}
+		props = out.properties(&record.Nsi, props)
+		var builder bytes.Buffer
+		builder.Write(props[:len(props)-1])
+		for f, value := range or.zoneValues(&record) {
+			v, _ := json.Marshal(value)
+			builder.WriteString(fmt.Sprintf(`,"%s":%s`, or.Fields[f].Name, v))
+		}
+		builder.WriteString("}")
+		if i > 0 {
+			c.Response().Write(featureSeparator)
+		}
+		x, y := out.Point(record.Point())
+		c.Response().Write([]byte(fmt.Sprintf(featureTemplate, x, y)))
+		c.Response().Write(builder.Bytes())
+		c.Response().Write(featureEnd)
+	}
+	c.Response().Write(arrayEnd)
+	c.Response().Write(featureEnd)
+	c.Response().Flush()
+	return rows.Err()
+}
+
+func (api *ApiHandler) writeOverlay(or *overlayRequest, writer *gis.PointWriter) (int, error) {
+	rows, err := api.DataStore.Db.Queryx(or.Sql, or.Params...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	record := overlayRecord{}
+	count := 0
+	for rows.Next() {
+		err = rows.StructScan(&record)
+		if err != nil {
+			return count, err
+		}
+		err = writer.Write(record.X, record.Y, append(nsiValues(&record.Nsi), or.zoneValues(&record)...))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// writeOverlaySummaries adds the summaries as a table of the export
+func writeOverlaySummaries(writer *gis.PointWriter, summaries *overlaySummaries) error {
+	fields := []gis.Field{{Name: summaries.SummaryBy, Type: ogr.FT_String}}
+	names, values := gis.SummaryValues(&stores.NsiSummary{})
+	for i, name := range names {
+		fieldType := ogr.FT_Real
+		switch values[i].(type) {
+		case int32, int64:
+			fieldType = ogr.FT_Integer64
+		}
+		fields = append(fields, gis.Field{Name: name, Type: fieldType})
+	}
+	rows := make([][]interface{}, len(summaries.Summaries))
+	for i, s := range summaries.Summaries {
+		_, values := gis.SummaryValues(&s.NsiSummary)
+		rows[i] = append([]interface{}{s.Value}, values...)
+	}
+	return writer.WriteTable("overlay_summary", fields, rows)
+}
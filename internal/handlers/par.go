@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/consequences"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+// parFields are the structure attributes used as life loss model input
+var parFields = []gis.Field{
+	{Name: "fd_id", Type: ogr.FT_Integer64},
+	{Name: "occtype", Type: ogr.FT_String},
+	{Name: "st_damcat", Type: ogr.FT_String},
+	{Name: "cbfips", Type: ogr.FT_String},
+	{Name: "num_story", Type: ogr.FT_Integer},
+	{Name: "found_ht", Type: ogr.FT_Real},
+	{Name: "found_type", Type: ogr.FT_String},
+	{Name: "ground_elv", Type: ogr.FT_Real},
+	{Name: "pop2amu65", Type: ogr.FT_Integer},
+	{Name: "pop2amo65", Type: ogr.FT_Integer},
+	{Name: "pop2pmu65", Type: ogr.FT_Integer},
+	{Name: "pop2pmo65", Type: ogr.FT_Integer},
+	{Name: "o65disable", Type: ogr.FT_Real},
+	{Name: "u65disable", Type: ogr.FT_Real},
+	{Name: "night_disabled", Type: ogr.FT_Real},
+	{Name: "day_disabled", Type: ogr.FT_Real},
+	{Name: "hazard", Type: ogr.FT_Real},
+}
+
+// parRequest selects the structures at risk.  With a hazard raster only
+// structures where the hazard exceeds Threshold are at risk.
+type parRequest struct {
+	Sql        string
+	Params     []interface{}
+	RasterFile string
+	Threshold  float64
+}
+
+// GetPopulationAtRisk reports the day and night population of the structures
+// selected by the query parameters.  With a format the structures and their
+// population are exported by a job for use in life loss models, with the
+// totals in the job summary and, for formats with tables, in the export.
+func (api *ApiHandler) GetPopulationAtRisk(c echo.Context) error {
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	pr := parRequest{}
+	criteria, params, err := getQueryCriteria(c)
+	if err != nil {
+		return err
+	}
+	pr.setQuery(d, criteria, params)
+	return api.populationAtRisk(c, &pr)
+}
+
+// PopulationAtRiskFromUpload reports the population at risk within an
+// uploaded area of interest, or wherever an uploaded hazard raster in the
+// raster form field exceeds the threshold parameter
+func (api *ApiHandler) PopulationAtRiskFromUpload(c echo.Context) error {
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	pr := parRequest{}
+	api.limitUpload(c)
+	if _, err := c.FormFile("raster"); err == nil {
+		return api.populationAtRiskFromRaster(c, d, &pr)
+	} else if api.isUploadTooLarge(err) {
+		return api.uploadTooLargeError()
+	}
+	geodataPost, err := api.openUpload(c)
+	if err != nil {
+		return err
+	}
+	defer geodataPost.Close()
+	filterGeom, err := geodataPost.GetGeometry()
+	if err != nil {
+		return uploadHTTPError(err)
+	}
+	defer filterGeom.Destroy()
+	geomWkt, err := filterGeom.ToWKT()
+	if err != nil {
+		return err
+	}
+	criteria, params, err := getQueryCriteria(c, getGeometryCriteria(geomWkt, 4326))
+	if err != nil {
+		return err
+	}
+	pr.setQuery(d, criteria, params)
+	return api.populationAtRisk(c, &pr)
+}
+
+func (api *ApiHandler) populationAtRiskFromRaster(c echo.Context, d models.Dataset, pr *parRequest) error {
+	if threshold := c.QueryParam("threshold"); threshold != "" {
+		var err error
+		pr.Threshold, err = strconv.ParseFloat(threshold, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid threshold: %s", threshold))
+		}
+	}
+	rasterFile, err := api.saveRasterUpload(c, "raster")
+	if err != nil {
+		return err
+	}
+	tempDir := filepath.Dir(rasterFile)
+	grid, err := gis.OpenGrid(rasterFile)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	minX, minY, maxX, maxY := grid.Bounds()
+	grid.Close()
+	criteria, params, err := getQueryCriteria(c, fmt.Sprintf("st_intersects(shape,st_makeenvelope(%f,%f,%f,%f,4326))", minX, minY, maxX, maxY))
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+	pr.RasterFile = rasterFile
+	pr.setQuery(d, criteria, params)
+	err = api.populationAtRisk(c, pr)
+	if err != nil || c.QueryParam("format") == "" {
+		os.RemoveAll(tempDir)
+	}
+	return err
+}
+
+func (pr *parRequest) setQuery(d models.Dataset, criteria string, params []interface{}) {
+	pr.Sql = strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName)
+	pr.Params = params
+}
+
+// populationAtRisk returns the totals, or starts a job exporting the
+// structures at risk when a format is requested
+func (api *ApiHandler) populationAtRisk(c echo.Context, pr *parRequest) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	if format == "" {
+		par, _, err := api.sumPopulationAtRisk(pr, nil)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, par)
+	}
+	exportFormat, ok := gis.ExportFormats[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+	}
+	return api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		if pr.RasterFile != "" {
+			defer os.RemoveAll(filepath.Dir(pr.RasterFile))
+		}
+		writer, err := gis.NewPointWriter(localFile, exportFormat, "population_at_risk", parFields)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer writer.Close()
+		par, count, err := api.sumPopulationAtRisk(pr, writer)
+		if err != nil {
+			return count, nil, err
+		}
+		if exportFormat.Tables {
+			err = writeParTotals(writer, par)
+			if err != nil {
+				return count, nil, fmt.Errorf("Unable to write population at risk totals: %s", err)
+			}
+		}
+		return count, par, nil
+	})
+}
+
+// sumPopulationAtRisk totals the population of the structures at risk,
+// writing each structure when given a writer
+func (api *ApiHandler) sumPopulationAtRisk(pr *parRequest, writer *gis.PointWriter) (*consequences.PopulationAtRisk, int, error) {
+	var grid *gis.Grid
+	if pr.RasterFile != "" {
+		var err error
+		grid, err = gis.OpenGrid(pr.RasterFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer grid.Close()
+	}
+	rows, err := api.DataStore.Db.Queryx(pr.Sql, pr.Params...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	par := consequences.NewPopulationAtRisk()
+	nsi := stores.Nsi{}
+	count := 0
+	for rows.Next() {
+		err = rows.StructScan(&nsi)
+		if err != nil {
+			return nil, count, err
+		}
+		var hazard interface{}
+		if grid != nil {
+			value, ok := grid.Sample(nsi.X, nsi.Y)
+			if !ok || value <= pr.Threshold {
+				continue
+			}
+			hazard = value
+		}
+		par.Add(&nsi)
+		count++
+		if writer != nil {
+			err = writer.Write(nsi.X, nsi.Y, []interface{}{
+				nsi.Fd_id, nsi.Occtype, nsi.St_damcat, nsi.CbFips, nsi.Num_story, nsi.Found_ht, nsi.Found_type,
+				nsi.Ground_elv, nsi.Pop2amu65, nsi.Pop2amo65, nsi.Pop2pmu65, nsi.Pop2pmo65, nsi.O65disable,
+				nsi.U65disable, consequences.NightDisabled(&nsi), consequences.DayDisabled(&nsi), hazard,
+			})
+			if err != nil {
+				return nil, count, err
+			}
+		}
+	}
+	return par, count, rows.Err()
+}
+
+var populationFields = []gis.Field{
+	{Name: "structures", Type: ogr.FT_Integer64},
+	{Name: "disabled_structures", Type: ogr.FT_Integer64},
+	{Name: "night_under65", Type: ogr.FT_Integer64},
+	{Name: "night_over65", Type: ogr.FT_Integer64},
+	{Name: "day_under65", Type: ogr.FT_Integer64},
+	{Name: "day_over65", Type: ogr.FT_Integer64},
+	{Name: "night", Type: ogr.FT_Integer64},
+	{Name: "day", Type: ogr.FT_Integer64},
+	{Name: "night_disabled", Type: ogr.FT_Real},
+	{Name: "day_disabled", Type: ogr.FT_Real},
+}
+
+// writeParTotals adds the population by damage category and occupancy class
+// as tables
+func writeParTotals(writer *gis.PointWriter, par *consequences.PopulationAtRisk) error {
+	for _, table := range []struct {
+		name   string
+		key    string
+		groups map[string]*consequences.Population
+	}{
+		{"par_by_damcat", "st_damcat", par.ByDamcat},
+		{"par_by_occupancy", "occupancy", par.ByOccupancy},
+	} {
+		fields := append([]gis.Field{{Name: table.key, Type: ogr.FT_String}}, populationFields...)
+		var rows [][]interface{}
+		for key, p := range table.groups {
+			rows = append(rows, []interface{}{
+				key, p.Structures, p.DisabledStructures, p.NightUnder65, p.NightOver65,
+				p.DayUnder65, p.DayOver65, p.Night, p.Day, p.NightDisabled, p.DayDisabled,
+			})
+		}
+		err := writer.WriteTable(table.name, fields, rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
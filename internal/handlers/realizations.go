@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/consequences"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+const maxRealizations = 1000
+
+var realizationFields = []gis.Field{
+	{Name: "fd_id", Type: ogr.FT_Integer64},
+	{Name: "realization", Type: ogr.FT_Integer},
+	{Name: "occtype", Type: ogr.FT_String},
+	{Name: "found_ht", Type: ogr.FT_Real},
+	{Name: "val_struct", Type: ogr.FT_Real},
+	{Name: "val_cont", Type: ogr.FT_Real},
+}
+
+// realizationRequest is the optional json body of a realizations request
+type realizationRequest struct {
+	Realizations  int                                            `json:"realizations"`
+	Seed          *int64                                         `json:"seed"`
+	Distributions map[string]consequences.AttributeDistributions `json:"distributions"`
+}
+
+type realizationSummary struct {
+	Seed         int64 `json:"seed"`
+	Realizations int   `json:"realizations"`
+	Structures   int   `json:"structures"`
+}
+
+// GenerateRealizations starts a job drawing realizations of the foundation
+// height, structure value and content value of the structures selected by
+// the query parameters.  Each realization is a row of the export, which is
+// parquet by default when gdal has the driver and gpkg otherwise.  The seed
+// is recorded in the job summary when one is not given.
+func (api *ApiHandler) GenerateRealizations(c echo.Context) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	if format == "" {
+		format = "gpkg"
+		if _, ok := gis.ExportFormats["parquet"]; ok {
+			format = "parquet"
+		}
+	}
+	exportFormat, ok := gis.ExportFormats[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+	}
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	generator, err := newRealizationGenerator(c)
+	if err != nil {
+		return err
+	}
+	criteria, params, err := getQueryCriteria(c)
+	if err != nil {
+		return err
+	}
+	if api.Config.ExportMaxFeatures > 0 {
+		var count int64
+		err = api.DataStore.Db.Get(&count, fmt.Sprintf("select count(*) from %s %s", d.TableName, criteria), params...)
+		if err != nil {
+			return err
+		}
+		if count*int64(generator.Realizations) > api.Config.ExportMaxFeatures {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%d realizations of %d structures exceeds the maximum of %d rows", generator.Realizations, count, api.Config.ExportMaxFeatures))
+		}
+	}
+	sql := strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiSelect, criteria), "{table_name}", d.TableName)
+	return api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		writer, err := gis.NewPointWriter(localFile, exportFormat, "nsi_realizations", realizationFields)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer writer.Close()
+		rows, err := api.DataStore.Db.Queryx(sql, params...)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer rows.Close()
+		summary := realizationSummary{Seed: generator.Seed, Realizations: generator.Realizations}
+		nsi := stores.Nsi{}
+		count := 0
+		for rows.Next() {
+			err = rows.StructScan(&nsi)
+			if err != nil {
+				return count, nil, err
+			}
+			for _, r := range generator.Generate(&nsi) {
+				err = writer.Write(nsi.X, nsi.Y, []interface{}{nsi.Fd_id, r.Number, nsi.Occtype, r.FoundHt, r.ValStruct, r.ValCont})
+				if err != nil {
+					return count, nil, err
+				}
+				count++
+			}
+			summary.Structures++
+		}
+		return count, &summary, rows.Err()
+	})
+}
+
+// newRealizationGenerator reads the distributions from the json body.  The
+// realizations and seed parameters override the body.
+func newRealizationGenerator(c echo.Context) (*consequences.RealizationGenerator, error) {
+	req := realizationRequest{}
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid realizations request: %s", err))
+		}
+	}
+	if realizations := c.QueryParam("realizations"); realizations != "" {
+		req.Realizations, err = strconv.Atoi(realizations)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid realizations: %s", realizations))
+		}
+	}
+	if seed := c.QueryParam("seed"); seed != "" {
+		s, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid seed: %s", seed))
+		}
+		req.Seed = &s
+	}
+	generator := consequences.RealizationGenerator{
+		Seed:          time.Now().UnixNano(),
+		Realizations:  req.Realizations,
+		Distributions: req.Distributions,
+	}
+	if req.Seed != nil {
+		generator.Seed = *req.Seed
+	}
+	err = generator.Validate(maxRealizations)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return &generator, nil
+}
@@ -0,0 +1,540 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+)
+
+// scenarioProtectedColumns identify a structure and cannot be edited
+var scenarioProtectedColumns = map[string]bool{"fd_id": true, "x": true, "y": true, "shape": true}
+
+var numericColumnTypes = map[string]bool{
+	"smallint":         true,
+	"integer":          true,
+	"bigint":           true,
+	"numeric":          true,
+	"real":             true,
+	"double precision": true,
+}
+
+var textColumnTypes = map[string]bool{
+	"text":              true,
+	"character varying": true,
+	"character":         true,
+}
+
+// scenarioDocument is the json form of a scenario, for example elevating
+// residential structures in the floodplain by 3 ft:
+//
+//	{"name": "elevate res1", "rules": [{"filter": {"occtype": "RES1*", "firmzone": "A*,V*"},
+//	  "set": {"found_ht": {"add": 3}}}]}
+type scenarioDocument struct {
+	Id          string         `json:"id,omitempty"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Rules       []scenarioRule `json:"rules"`
+	DateCreated *time.Time     `json:"date_created,omitempty"`
+	CreatedBy   string         `json:"created_by,omitempty"`
+}
+
+// scenarioRule deletes or edits the structures matching its filter.  Rules
+// are applied in order, so a filter sees the edits of the rules before it.
+// Filter keys are fips, fd_id and the categorical fields of the structure
+// queries, with the same comma separated values.  An empty filter matches
+// every structure.
+type scenarioRule struct {
+	Filter map[string]string       `json:"filter"`
+	Delete bool                    `json:"delete,omitempty"`
+	Set    map[string]scenarioEdit `json:"set,omitempty"`
+}
+
+// scenarioEdit replaces a value, or scales and then adds to a numeric value
+type scenarioEdit struct {
+	Value interface{} `json:"value,omitempty"`
+	Scale *float64    `json:"scale,omitempty"`
+	Add   *float64    `json:"add,omitempty"`
+}
+
+// scenarioLineage records the source of an inventory derived from a scenario
+type scenarioLineage struct {
+	DatasetId       *uuid.UUID     `json:"dataset_id,omitempty"`
+	SourceDatasetId uuid.UUID      `json:"source_dataset_id"`
+	SourceDataset   string         `json:"source_dataset,omitempty"`
+	SourceVersion   string         `json:"source_version,omitempty"`
+	ScenarioId      *uuid.UUID     `json:"scenario_id"`
+	Rules           []scenarioRule `json:"rules"`
+	DateCreated     *time.Time     `json:"date_created,omitempty"`
+	CreatedBy       string         `json:"created_by,omitempty"`
+}
+
+type derivedDataset struct {
+	Id        uuid.UUID       `json:"id"`
+	Name      string          `json:"name"`
+	Version   string          `json:"version"`
+	TableName string          `json:"table_name"`
+	Lineage   scenarioLineage `json:"lineage"`
+}
+
+func (doc *scenarioDocument) Validate() error {
+	if strings.TrimSpace(doc.Name) == "" {
+		return errors.New("scenario name is required")
+	}
+	if len(doc.Rules) == 0 {
+		return errors.New("scenario must have at least one rule")
+	}
+	for i, rule := range doc.Rules {
+		err := rule.Validate()
+		if err != nil {
+			return fmt.Errorf("rule %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r scenarioRule) Validate() error {
+	for key := range r.Filter {
+		if key != "fips" && key != "fd_id" && !containsString(filterFields, key) {
+			return fmt.Errorf("invalid filter field: %s", key)
+		}
+	}
+	if r.Delete == (len(r.Set) > 0) {
+		return errors.New("rule must either delete or set attributes")
+	}
+	for field, edit := range r.Set {
+		if scenarioProtectedColumns[field] {
+			return fmt.Errorf("%s cannot be edited", field)
+		}
+		if edit.Value != nil && (edit.Scale != nil || edit.Add != nil) {
+			return fmt.Errorf("%s value cannot be combined with scale or add", field)
+		}
+		if edit.Value == nil && edit.Scale == nil && edit.Add == nil {
+			return fmt.Errorf("%s edit needs a value, scale or add", field)
+		}
+		switch edit.Value.(type) {
+		case nil, string, float64:
+		default:
+			return fmt.Errorf("%s value must be a string or number", field)
+		}
+	}
+	return nil
+}
+
+// criteria returns the sql condition of the rule filter
+func (r scenarioRule) criteria(params []interface{}) (string, []interface{}, error) {
+	fipsCriteria, params, err := getFipsCriteria(r.Filter["fips"], params)
+	if err != nil {
+		return "", nil, err
+	}
+	var fdIdCriteria string
+	if fdIds := r.Filter["fd_id"]; fdIds != "" {
+		ids := strings.Split(fdIds, ",")
+		for i, id := range ids {
+			_, err := strconv.ParseInt(strings.TrimSpace(id), 10, 32)
+			if err != nil {
+				return "", nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid fd_id: %s", id))
+			}
+			ids[i] = strings.TrimSpace(id)
+		}
+		fdIdCriteria = fmt.Sprintf("fd_id in (%s)", strings.Join(ids, ","))
+	}
+	attributeCriteria, params := getAttributeCriteria(func(field string) string { return r.Filter[field] }, params)
+	criteria := strings.TrimPrefix(buildCritieria(append([]string{fipsCriteria, fdIdCriteria}, attributeCriteria...)...), "where ")
+	if criteria == "" {
+		criteria = "true"
+	}
+	return criteria, params, nil
+}
+
+// expr returns the sql expression of an edit to column
+func (e scenarioEdit) expr(column stores.TableColumn, params []interface{}) (string, []interface{}, error) {
+	numeric := numericColumnTypes[column.Type]
+	if !numeric && !textColumnTypes[column.Type] {
+		return "", nil, fmt.Errorf("%s column of type %s cannot be edited", column.Name, column.Type)
+	}
+	switch v := e.Value.(type) {
+	case float64:
+		if !numeric {
+			return "", nil, fmt.Errorf("%s value must be a string", column.Name)
+		}
+		params = append(params, v)
+		return fmt.Sprintf("$%d::double precision", len(params)), params, nil
+	case string:
+		if numeric {
+			return "", nil, fmt.Errorf("%s value must be a number", column.Name)
+		}
+		params = append(params, v)
+		return fmt.Sprintf("$%d::text", len(params)), params, nil
+	}
+	if !numeric {
+		return "", nil, fmt.Errorf("%s is not numeric and can only be given a value", column.Name)
+	}
+	expr := quoteIdentifier(column.Name)
+	if e.Scale != nil {
+		params = append(params, *e.Scale)
+		expr = fmt.Sprintf("%s*$%d::double precision", expr, len(params))
+	}
+	if e.Add != nil {
+		params = append(params, *e.Add)
+		expr = fmt.Sprintf("%s+$%d::double precision", expr, len(params))
+	}
+	return expr, params, nil
+}
+
+// scenarioSql wraps the select of the source rows matching criteria in a
+// select for every rule and returns the select of the scenario inventory
+func scenarioSql(tableName string, columns []stores.TableColumn, criteria string, params []interface{}, rules []scenarioRule) (string, []interface{}, error) {
+	columnsByName := make(map[string]stores.TableColumn, len(columns))
+	for _, column := range columns {
+		columnsByName[column.Name] = column
+	}
+	sql := fmt.Sprintf("select * from %s %s", tableName, criteria)
+	for i, rule := range rules {
+		condition, p, err := rule.criteria(params)
+		if err != nil {
+			return "", nil, err
+		}
+		params = p
+		if rule.Delete {
+			sql = fmt.Sprintf("select * from (%s) r%d where not coalesce((%s),false)", sql, i, condition)
+			continue
+		}
+		for field := range rule.Set {
+			if _, ok := columnsByName[field]; !ok {
+				return "", nil, fmt.Errorf("rule %d: unknown field %s", i+1, field)
+			}
+		}
+		selectList := make([]string, len(columns))
+		for c, column := range columns {
+			name := quoteIdentifier(column.Name)
+			selectList[c] = name
+			edit, ok := rule.Set[column.Name]
+			if !ok {
+				continue
+			}
+			expr, p, err := edit.expr(column, params)
+			if err != nil {
+				return "", nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+			params = p
+			selectList[c] = fmt.Sprintf("cast(case when %s then %s else %s end as %s) as %s", condition, expr, name, column.Type, name)
+		}
+		sql = fmt.Sprintf("select %s from (%s) r%d", strings.Join(selectList, ","), sql, i)
+	}
+	return sql, params, nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (api *ApiHandler) GetScenarios(c echo.Context) error {
+	scenarios, err := api.DataStore.GetScenarios()
+	if err != nil {
+		return err
+	}
+	docs := make([]scenarioDocument, len(scenarios))
+	for i, s := range scenarios {
+		docs[i], err = newScenarioDocument(s)
+		if err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, docs)
+}
+
+func (api *ApiHandler) GetScenario(c echo.Context) error {
+	scenario, err := api.scenario(c)
+	if err != nil {
+		return err
+	}
+	doc, err := newScenarioDocument(scenario)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// AddScenario saves a scenario definition.  Scenarios cannot be changed so
+// the lineage of the inventories derived from them stays valid.
+func (api *ApiHandler) AddScenario(c echo.Context) error {
+	userId, err := api.userId(c)
+	if err != nil {
+		return err
+	}
+	var doc scenarioDocument
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &doc)
+	if err == nil {
+		err = doc.Validate()
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid scenario: %s", err))
+	}
+	scenarios, err := api.DataStore.GetScenarios()
+	if err != nil {
+		return err
+	}
+	for _, s := range scenarios {
+		if s.Name == doc.Name {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("scenario %s already exists", doc.Name))
+		}
+	}
+	definition, err := json.Marshal(doc.Rules)
+	if err != nil {
+		return err
+	}
+	scenario := models.Scenario{
+		Name:        doc.Name,
+		Description: doc.Description,
+		Definition:  string(definition),
+		CreatedBy:   userId,
+	}
+	err = api.DataStore.AddScenario(&scenario)
+	if err != nil {
+		return err
+	}
+	doc.Id = scenario.Id.String()
+	doc.CreatedBy = userId
+	return c.JSON(http.StatusCreated, doc)
+}
+
+// DeleteScenario removes a scenario.  Only its creator or an admin can
+// delete it.
+func (api *ApiHandler) DeleteScenario(c echo.Context) error {
+	userId, err := api.userId(c)
+	if err != nil {
+		return err
+	}
+	scenario, err := api.scenario(c)
+	if err != nil {
+		return err
+	}
+	if scenario.CreatedBy != userId {
+		_, err = api.requireAdmin(c)
+		if err != nil {
+			return err
+		}
+	}
+	err = api.DataStore.DeleteScenario(scenario.Id)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ApplyScenario applies a scenario to the structures of the dataset selected
+// by the query parameters.  With output_dataset and output_version the
+// result is saved as a new dataset, which requires the admin role.
+// Otherwise a job exports the result in format, defaulting to gpkg.
+func (api *ApiHandler) ApplyScenario(c echo.Context) error {
+	scenario, err := api.scenario(c)
+	if err != nil {
+		return err
+	}
+	var rules []scenarioRule
+	err = json.Unmarshal([]byte(scenario.Definition), &rules)
+	if err != nil {
+		return err
+	}
+	source, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	columns, err := api.DataStore.GetTableColumns(source.TableName)
+	if err != nil {
+		return err
+	}
+	criteria, queryParams, err := getQueryCriteria(c)
+	if err != nil {
+		return err
+	}
+	sql, params, err := scenarioSql(source.TableName, columns, criteria, queryParams, rules)
+	if err != nil {
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	scenarioId := scenario.Id
+	lineage := scenarioLineage{
+		SourceDatasetId: source.Id,
+		SourceDataset:   source.Name,
+		SourceVersion:   source.Version,
+		ScenarioId:      &scenarioId,
+		Rules:           rules,
+	}
+	if c.QueryParam("output_dataset") != "" || c.QueryParam("output_version") != "" {
+		return api.addScenarioDataset(c, source, scenario, sql, params, lineage)
+	}
+	format := strings.ToLower(c.QueryParam("format"))
+	if format == "" {
+		format = "gpkg"
+	}
+	exportFormat, ok := gis.ExportFormats[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+	}
+	if api.Config.ExportMaxFeatures > 0 {
+		var count int64
+		err = api.DataStore.Db.Get(&count, fmt.Sprintf("select count(*) from %s %s", source.TableName, criteria), queryParams...)
+		if err != nil {
+			return err
+		}
+		if count > api.Config.ExportMaxFeatures {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%d structures exceeds the maximum of %d", count, api.Config.ExportMaxFeatures))
+		}
+	}
+	exportSql := strings.ReplaceAll(stores.NsiSelect, "{table_name}", fmt.Sprintf("(%s) s", sql))
+	return api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		writer, err := gis.NewPointWriter(localFile, exportFormat, "nsi_scenario", nsiPointFields())
+		if err != nil {
+			return 0, nil, err
+		}
+		defer writer.Close()
+		rows, err := api.DataStore.Db.Queryx(exportSql, params...)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer rows.Close()
+		nsi := stores.Nsi{}
+		count := 0
+		for rows.Next() {
+			err = rows.StructScan(&nsi)
+			if err != nil {
+				return count, nil, err
+			}
+			err = writer.Write(nsi.X, nsi.Y, nsiValues(&nsi))
+			if err != nil {
+				return count, nil, err
+			}
+			count++
+		}
+		return count, &lineage, rows.Err()
+	})
+}
+
+func (api *ApiHandler) addScenarioDataset(c echo.Context, source models.Dataset, scenario models.Scenario,
+	sql string, params []interface{}, lineage scenarioLineage) error {
+	userId, err := api.requireAdmin(c)
+	if err != nil {
+		return err
+	}
+	d := models.Dataset{
+		Name:      c.QueryParam("output_dataset"),
+		Version:   c.QueryParam("output_version"),
+		QualityId: source.QualityId,
+	}
+	if d.Name == "" || d.Version == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "output_dataset and output_version are both required")
+	}
+	err = api.DataStore.GetDataset(&d)
+	if err != nil {
+		return err
+	}
+	if d.Id != uuid.Nil {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("dataset %s version %s already exists", d.Name, d.Version))
+	}
+	tableId, _ := uuid.NewUUID()
+	d.TableName = "nsi_" + strings.ReplaceAll(tableId.String(), "-", "")
+	d.SchemaId = source.SchemaId
+	d.GroupId = source.GroupId
+	d.Description = scenario.Description
+	d.Purpose = fmt.Sprintf("scenario %s applied to %s %s", scenario.Name, source.Name, source.Version)
+	d.CreatedBy = userId
+	definition, err := json.Marshal(lineage.Rules)
+	if err != nil {
+		return err
+	}
+	model := models.DatasetLineage{
+		SourceDatasetId: source.Id,
+		ScenarioId:      uuid.NullUUID{UUID: scenario.Id, Valid: true},
+		Definition:      string(definition),
+		CreatedBy:       userId,
+	}
+	err = api.DataStore.AddDerivedDataset(&d, source, sql, params, &model)
+	if err != nil {
+		return err
+	}
+	lineage.DatasetId = &d.Id
+	lineage.CreatedBy = userId
+	return c.JSON(http.StatusCreated, derivedDataset{
+		Id:        d.Id,
+		Name:      d.Name,
+		Version:   d.Version,
+		TableName: d.TableName,
+		Lineage:   lineage,
+	})
+}
+
+// GetDatasetLineage returns the source dataset and scenario of a dataset
+// derived from a scenario
+func (api *ApiHandler) GetDatasetLineage(c echo.Context) error {
+	d, err := api.getDataset(c)
+	if err != nil {
+		return err
+	}
+	model, err := api.DataStore.GetDatasetLineage(d.Id)
+	if err != nil {
+		return err
+	}
+	if model.Id == uuid.Nil {
+		return echo.NewHTTPError(http.StatusNotFound, "dataset was not derived from a scenario")
+	}
+	lineage := scenarioLineage{
+		DatasetId:       &d.Id,
+		SourceDatasetId: model.SourceDatasetId,
+		DateCreated:     &model.DateCreated,
+		CreatedBy:       model.CreatedBy,
+	}
+	if model.ScenarioId.Valid {
+		lineage.ScenarioId = &model.ScenarioId.UUID
+	}
+	err = json.Unmarshal([]byte(model.Definition), &lineage.Rules)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, lineage)
+}
+
+func (api *ApiHandler) scenario(c echo.Context) (models.Scenario, error) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return models.Scenario{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid scenario id: %s", c.Param("id")))
+	}
+	scenario, err := api.DataStore.GetScenario(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && scenario.Id == uuid.Nil) {
+		return scenario, echo.NewHTTPError(http.StatusNotFound, "scenario not found")
+	}
+	return scenario, err
+}
+
+func newScenarioDocument(s models.Scenario) (scenarioDocument, error) {
+	doc := scenarioDocument{
+		Id:          s.Id.String(),
+		Name:        s.Name,
+		Description: s.Description,
+		DateCreated: &s.DateCreated,
+		CreatedBy:   s.CreatedBy,
+	}
+	err := json.Unmarshal([]byte(s.Definition), &doc.Rules)
+	return doc, err
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+func TestScenarioSql(t *testing.T) {
+	columns := []stores.TableColumn{
+		{Name: "fd_id", Type: "integer"},
+		{Name: "occtype", Type: "character varying"},
+		{Name: "val_struct", Type: "double precision"},
+	}
+	scale, add := 1.1, 500.0
+	tests := []struct {
+		name    string
+		rules   []scenarioRule
+		sql     string
+		params  []interface{}
+		wantErr string
+	}{
+		{
+			name:   "delete",
+			rules:  []scenarioRule{{Filter: map[string]string{"occtype": "RES2"}, Delete: true}},
+			sql:    `select * from (select * from nsi where x=$1) r0 where not coalesce(((occtype=$2)),false)`,
+			params: []interface{}{"a", "RES2"},
+		},
+		{
+			name: "set value",
+			rules: []scenarioRule{{Filter: map[string]string{"fd_id": "1, 2"},
+				Set: map[string]scenarioEdit{"occtype": {Value: "COM1"}}}},
+			sql: `select "fd_id",cast(case when fd_id in (1,2) then $2::text else "occtype" end as character varying) as "occtype","val_struct"` +
+				` from (select * from nsi where x=$1) r0`,
+			params: []interface{}{"a", "COM1"},
+		},
+		{
+			name:  "scale and add every structure",
+			rules: []scenarioRule{{Set: map[string]scenarioEdit{"val_struct": {Scale: &scale, Add: &add}}}},
+			sql: `select "fd_id","occtype",cast(case when true then "val_struct"*$2::double precision+$3::double precision else "val_struct" end as double precision) as "val_struct"` +
+				` from (select * from nsi where x=$1) r0`,
+			params: []interface{}{"a", 1.1, 500.0},
+		},
+		{
+			name: "rules apply in order",
+			rules: []scenarioRule{
+				{Filter: map[string]string{"fips": "01"}, Delete: true},
+				{Filter: map[string]string{"occtype": "RES1*"}, Set: map[string]scenarioEdit{"val_struct": {Value: 1.0}}},
+			},
+			sql: `select "fd_id","occtype",cast(case when (occtype like $3) then $4::double precision else "val_struct" end as double precision) as "val_struct"` +
+				` from (select * from (select * from nsi where x=$1) r0 where not coalesce(((substr(cbfips,1,2)=$2)),false)) r1`,
+			params: []interface{}{"a", "01", "RES1%", 1.0},
+		},
+		{
+			name:    "unknown field",
+			rules:   []scenarioRule{{Set: map[string]scenarioEdit{"missing": {Value: "x"}}}},
+			wantErr: "rule 1: unknown field missing",
+		},
+		{
+			name:    "text value for a number",
+			rules:   []scenarioRule{{Set: map[string]scenarioEdit{"val_struct": {Value: "x"}}}},
+			wantErr: "val_struct value must be a number",
+		},
+		{
+			name:    "scale text",
+			rules:   []scenarioRule{{Set: map[string]scenarioEdit{"occtype": {Scale: &scale}}}},
+			wantErr: "occtype is not numeric",
+		},
+		{
+			name:    "invalid fd_id",
+			rules:   []scenarioRule{{Filter: map[string]string{"fd_id": "1 or true"}, Delete: true}},
+			wantErr: "Invalid fd_id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, params, err := scenarioSql("nsi", columns, "where x=$1", []interface{}{"a"}, tt.rules)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("scenarioSql() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != tt.sql || !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("scenarioSql() =\n%s\n%v\nwant\n%s\n%v", sql, params, tt.sql, tt.params)
+			}
+		})
+	}
+}
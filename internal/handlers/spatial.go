@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/labstack/echo"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkt"
+	"github.com/paulmach/orb/geojson"
+)
+
+// spatialPredicate returns the criteria relating the inventory shape to a
+// filter geometry in EPSG:4326
+type spatialPredicate func(geom string) string
+
+// getSpatialCriteria filters the inventory by the bbox and geometry parameters.
+// The bbox is either minx,miny,maxx,maxy or a flat list of ring coordinates in
+// the bbox-crs.  The geometry is WKT, EWKT or GeoJSON in the filter-crs.  Both
+// crs default to EPSG:4326.
+func getSpatialCriteria(c echo.Context) (string, error) {
+	bbox := c.QueryParam("bbox")
+	geometry := c.QueryParam("geometry")
+	if bbox == "" && geometry == "" {
+		return "", nil
+	}
+	predicate, err := getSpatialPredicate(c)
+	if err != nil {
+		return "", err
+	}
+	var criteria []string
+	if bbox != "" {
+		srid, err := parseSrid("bbox-crs", c.QueryParam("bbox-crs"))
+		if err != nil {
+			return "", err
+		}
+		geom, err := bboxGeometry(bbox, srid)
+		if err != nil {
+			return "", err
+		}
+		criteria = append(criteria, predicate(geom))
+	}
+	if geometry != "" {
+		srid, err := parseSrid("filter-crs", c.QueryParam("filter-crs"))
+		if err != nil {
+			return "", err
+		}
+		geom, err := parameterGeometry(geometry, srid)
+		if err != nil {
+			return "", err
+		}
+		criteria = append(criteria, predicate(geom))
+	}
+	return strings.Join(criteria, " and "), nil
+}
+
+// getSpatialPredicate returns the predicate given by the predicate parameter:
+// intersects (the default), within, or dwithin with a distance in
+// distance_units
+func getSpatialPredicate(c echo.Context) (spatialPredicate, error) {
+	predicate := strings.ToLower(c.QueryParam("predicate"))
+	switch predicate {
+	case "", "intersects":
+		return func(geom string) string {
+			return fmt.Sprintf("st_intersects(shape,%s)", geom)
+		}, nil
+	case "within":
+		return func(geom string) string {
+			return fmt.Sprintf("st_within(shape,%s)", geom)
+		}, nil
+	case "dwithin":
+		value := c.QueryParam("distance")
+		distance, err := strconv.ParseFloat(value, 64)
+		if err != nil || distance <= 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("dwithin requires a positive distance: %s", value))
+		}
+		units := strings.ToLower(c.QueryParam("distance_units"))
+		toMeters, ok := bufferUnits[units]
+		if !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid distance units: %s", units))
+		}
+		meters := distance * toMeters
+		return func(geom string) string {
+			//expanding the geometry by the distance in degrees at its highest latitude
+			//lets the spatial index narrow the geodesic comparison
+			expand := fmt.Sprintf("%f/(%f*greatest(cos(radians(greatest(abs(st_ymin(%s)),abs(st_ymax(%s))))),0.01))",
+				meters, metersPerDegree, geom, geom)
+			return fmt.Sprintf("(shape && st_expand(%s,%s) and st_dwithin(shape::geography,(%s)::geography,%f))",
+				geom, expand, geom, meters)
+		}, nil
+	}
+	return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid predicate: %s. Use intersects, within or dwithin", predicate))
+}
+
+// parseSrid accepts an EPSG code as 5070, EPSG:5070 or an OGC crs uri.  An
+// empty value or CRS84 is EPSG:4326.
+func parseSrid(name string, crs string) (int, error) {
+	value := strings.ToLower(strings.TrimSpace(crs))
+	if value == "" || strings.HasSuffix(value, "crs84") {
+		return 4326, nil
+	}
+	value = strings.TrimPrefix(value, "epsg:")
+	value = strings.TrimPrefix(value, "http://www.opengis.net/def/crs/epsg/0/")
+	srid, err := strconv.Atoi(value)
+	if err != nil || srid <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid %s: %s", name, crs))
+	}
+	return srid, nil
+}
+
+// bboxGeometry returns the sql for the bbox transformed to EPSG:4326
+func bboxGeometry(bbox string, srid int) (string, error) {
+	coords, err := gis.StringToCoords(bbox)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid bbox: %s", bbox))
+	}
+	c := *coords
+	if len(c) == 4 {
+		if c[0] >= c[2] || c[1] >= c[3] {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid bbox: expected minx,miny,maxx,maxy")
+		}
+		return toWgs84(fmt.Sprintf("st_makeenvelope(%f,%f,%f,%f,%d)", c[0], c[1], c[2], c[3], srid), srid), nil
+	}
+	if len(c) < 6 || len(c)%2 != 0 {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid bbox: expected minx,miny,maxx,maxy or a list of x,y ring coordinates")
+	}
+	poly := gis.LineStringToPoly(gis.CoordsToLineString(coords))
+	return ewkt(*poly, srid), nil
+}
+
+// parameterGeometry validates a WKT, EWKT or GeoJSON geometry parameter and
+// returns the sql for it transformed to EPSG:4326
+func parameterGeometry(geometry string, srid int) (string, error) {
+	geometry = strings.TrimSpace(geometry)
+	var geom orb.Geometry
+	if strings.HasPrefix(geometry, "{") {
+		var gj struct {
+			Type string `json:"type"`
+		}
+		err := json.Unmarshal([]byte(geometry), &gj)
+		if err != nil {
+			return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid GeoJSON geometry: %s", err))
+		}
+		if gj.Type == "Feature" {
+			feature, err := geojson.UnmarshalFeature([]byte(geometry))
+			if err != nil {
+				return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid GeoJSON feature: %s", err))
+			}
+			geom = feature.Geometry
+		} else {
+			g, err := geojson.UnmarshalGeometry([]byte(geometry))
+			if err != nil {
+				return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid GeoJSON geometry: %s", err))
+			}
+			geom = g.Geometry()
+		}
+	} else {
+		if strings.HasPrefix(strings.ToUpper(geometry), "SRID=") {
+			parts := strings.SplitN(geometry, ";", 2)
+			var err error
+			srid, err = parseSrid("geometry srid", strings.TrimPrefix(strings.ToUpper(parts[0]), "SRID="))
+			if err != nil || len(parts) < 2 {
+				return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid EWKT geometry")
+			}
+			geometry = parts[1]
+		}
+		g, err := wkt.Unmarshal(geometry)
+		if err != nil {
+			return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid WKT geometry: %s", err))
+		}
+		geom = g
+	}
+	if geom == nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "geometry is empty")
+	}
+	return ewkt(geom, srid), nil
+}
+
+// ewkt inlines a parsed geometry as sql transformed to EPSG:4326.  The wkt is
+// written from the parsed geometry so no user input reaches the query.
+func ewkt(geom orb.Geometry, srid int) string {
+	return toWgs84(fmt.Sprintf("'SRID=%d;%s'::geometry", srid, wkt.MarshalString(geom)), srid)
+}
+
+func toWgs84(geom string, srid int) string {
+	if srid == 4326 {
+		return geom
+	}
+	return fmt.Sprintf("st_transform(%s,4326)", geom)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/labstack/echo"
+	ogr "github.com/lukeroth/gdal"
+)
+
+// perFeatureStats summarizes the structures within each uploaded feature.
+// Small uploads are returned directly as geojson, large uploads and file
+// formats are run as a job.  perFeatureStats takes ownership of geodataPost.
+func (api *ApiHandler) perFeatureStats(c echo.Context, d models.Dataset, geodataPost *gis.GeodataPost) error {
+	format := strings.ToLower(c.QueryParam("format"))
+	if format == "" {
+		format = "geojson"
+	}
+	exportFormat, ok := gis.ExportFormats[format]
+	if !ok {
+		geodataPost.Close()
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid format: %s", format))
+	}
+	count, err := geodataPost.FeatureCount()
+	if err != nil {
+		geodataPost.Close()
+		return uploadHTTPError(err)
+	}
+	summarize, err := api.featureSummarizer(c, d)
+	if err != nil {
+		geodataPost.Close()
+		return err
+	}
+	if format == "geojson" && count <= api.Config.StatsAsyncFeatures {
+		defer geodataPost.Close()
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c.Response().WriteHeader(http.StatusOK)
+		_, err = geodataPost.WriteZonalStatsGeojson(c.Response(), summarize)
+		c.Response().Flush()
+		return err
+	}
+	err = api.startJob(c, format, func(localFile string) (int, interface{}, error) {
+		defer geodataPost.Close()
+		if format == "geojson" {
+			f, err := os.Create(localFile)
+			if err != nil {
+				return 0, nil, err
+			}
+			defer f.Close()
+			count, err := geodataPost.WriteZonalStatsGeojson(f, summarize)
+			return count, nil, err
+		}
+		count, err := geodataPost.WriteZonalStatsFile(localFile, exportFormat, summarize)
+		return count, nil, err
+	})
+	if err != nil {
+		geodataPost.Close()
+	}
+	return err
+}
+
+// featureSummarizer summarizes the structures within a feature that also
+// match the query criteria.  The feature geometry is the last parameter.
+func (api *ApiHandler) featureSummarizer(c echo.Context, d models.Dataset) (gis.Summarizer, error) {
+	criteria, params, err := getQueryCriteria(c)
+	if err != nil {
+		return nil, err
+	}
+	geomCriteria := fmt.Sprintf("st_intersects(shape,st_geomfromwkb($%d,4326))", len(params)+1)
+	criteria = buildCritieria(strings.TrimPrefix(criteria, "where "), geomCriteria)
+	sql := strings.ReplaceAll(fmt.Sprintf("%s %s", stores.NsiStatsSelect, criteria), "{table_name}", d.TableName)
+	return func(geom ogr.Geometry) (*stores.NsiSummary, error) {
+		gdalwkb, err := geom.ToWKB()
+		if err != nil {
+			return nil, err
+		}
+		featureParams := append(append([]interface{}{}, params...), gdalwkb)
+		var nsiSummary stores.NsiSummary
+		err = api.DataStore.Db.Get(&nsiSummary, sql, featureParams...)
+		return &nsiSummary, err
+	}, nil
+}
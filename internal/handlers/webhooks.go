@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/webhooks"
+	"github.com/labstack/echo"
+)
+
+type webhookRequest struct {
+	Url string `json:"url" form:"url" query:"url"`
+}
+
+func (api *ApiHandler) GetWebhooks(c echo.Context) error {
+	userId, err := api.userId(c)
+	if err != nil {
+		return err
+	}
+	hooks, err := api.TempStore.GetWebhooks(userId)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, hooks)
+}
+
+func (api *ApiHandler) AddWebhook(c echo.Context) error {
+	if !api.Webhooks.Enabled() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, webhooks.ErrDisabled.Error())
+	}
+	userId, err := api.userId(c)
+	if err != nil {
+		return err
+	}
+	var req webhookRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return err
+	}
+	err = webhooks.ValidateUrl(req.Url)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	hooks, err := api.TempStore.GetWebhooks(userId)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if hook.Url == req.Url {
+			return c.JSON(http.StatusOK, hooks)
+		}
+	}
+	hooks = append(hooks, stores.Webhook{Url: req.Url, Created: time.Now()})
+	err = api.TempStore.PutWebhooks(userId, hooks)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, hooks)
+}
+
+// DeleteWebhook removes the webhook given by the url parameter, or all of the
+// user's webhooks when no url is given
+func (api *ApiHandler) DeleteWebhook(c echo.Context) error {
+	userId, err := api.userId(c)
+	if err != nil {
+		return err
+	}
+	url := c.QueryParam("url")
+	hooks, err := api.TempStore.GetWebhooks(userId)
+	if err != nil {
+		return err
+	}
+	remaining := []stores.Webhook{}
+	if url != "" {
+		for _, hook := range hooks {
+			if hook.Url != url {
+				remaining = append(remaining, hook)
+			}
+		}
+	}
+	err = api.TempStore.PutWebhooks(userId, remaining)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, remaining)
+}
+
+// exportCallbacks combines the optional callback parameter of an export
+// request with any webhooks registered by the requesting user
+func (api *ApiHandler) exportCallbacks(c echo.Context) ([]stores.Callback, error) {
+	callbacks := []stores.Callback{}
+	userId := authenticatedUser(c)
+	if callback := c.FormValue("callback"); callback != "" {
+		if !api.Webhooks.Enabled() {
+			return nil, echo.NewHTTPError(http.StatusServiceUnavailable, webhooks.ErrDisabled.Error())
+		}
+		err := webhooks.ValidateUrl(callback)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		callbacks = append(callbacks, stores.Callback{Url: callback, Owner: userId})
+	}
+	if userId != "" && api.Webhooks.Enabled() {
+		hooks, err := api.TempStore.GetWebhooks(userId)
+		if err != nil {
+			return nil, err
+		}
+		for _, hook := range hooks {
+			callbacks = append(callbacks, stores.Callback{Url: hook.Url, Owner: userId})
+		}
+	}
+	return callbacks, nil
+}
@@ -86,3 +86,67 @@ type Member struct {
 	Role    types.Role `db:"role"`
 	UserId  string     `db:"user_id"`
 }
+
+//  Depth damage functions are organized as:
+//  DdfSet - Named and versioned set of functions
+//      Ddf - Function for an occupancy type
+//          DdfValue - Percent damage at a depth above the first floor
+//  DdfAssignment - Function used for an occupancy type of a dataset
+
+type DdfSet struct {
+	Id          uuid.UUID `db:"id"`
+	Name        string    `db:"name"`
+	Version     string    `db:"version"`
+	Description string    `db:"description"`
+	DateCreated time.Time `db:"date_created"`
+	CreatedBy   string    `db:"created_by"`
+}
+
+type Ddf struct {
+	Id      uuid.UUID  `db:"id"`
+	SetId   uuid.UUID  `db:"ddf_set_id"`
+	Occtype string     `db:"occtype"`
+	Name    string     `db:"name"`
+	Values  []DdfValue `db:"-"`
+}
+
+type DdfValue struct {
+	Id          uuid.UUID `db:"id"`
+	DdfId       uuid.UUID `db:"ddf_id"`
+	Depth       float64   `db:"depth"`
+	Structure   float64   `db:"structure"`
+	StructureSd float64   `db:"structure_sd"`
+	Contents    float64   `db:"contents"`
+	ContentsSd  float64   `db:"contents_sd"`
+}
+
+type DdfAssignment struct {
+	Id        uuid.UUID `db:"id"`
+	DatasetId uuid.UUID `db:"dataset_id"`
+	Occtype   string    `db:"occtype"`
+	DdfId     uuid.UUID `db:"ddf_id"`
+	SetId     uuid.UUID `db:"ddf_set_id"`
+	Name      string    `db:"name"`
+}
+
+//  Scenario - Named set of attribute edits and deletions applied to an inventory
+//  DatasetLineage - Source dataset and scenario definition of a derived dataset
+
+type Scenario struct {
+	Id          uuid.UUID `db:"id"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	Definition  string    `db:"definition"` // json rules
+	DateCreated time.Time `db:"date_created"`
+	CreatedBy   string    `db:"created_by"`
+}
+
+type DatasetLineage struct {
+	Id              uuid.UUID     `db:"id"`
+	DatasetId       uuid.UUID     `db:"dataset_id"`
+	SourceDatasetId uuid.UUID     `db:"source_dataset_id"`
+	ScenarioId      uuid.NullUUID `db:"scenario_id"`
+	Definition      string        `db:"definition"` // scenario rules when the dataset was derived
+	DateCreated     time.Time     `db:"date_created"`
+	CreatedBy       string        `db:"created_by"`
+}
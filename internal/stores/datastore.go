@@ -3,6 +3,8 @@ package stores
 import (
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
 
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/config"
 	_ "github.com/jackc/pgx/stdlib"
@@ -52,29 +54,63 @@ type Nsi struct {
 	Ground_elv float64 `db:"ground_elv" json:"ground_elv"`
 }
 
+// Point returns the structure location
+func (nsi *Nsi) Point() (float64, float64) {
+	return nsi.X, nsi.Y
+}
+
+// Elevations returns the ground elevation and foundation height in feet
+func (nsi *Nsi) Elevations() (float64, float64) {
+	return nsi.Ground_elv, nsi.Found_ht
+}
+
+// NsiDistance is an inventory record with its distance in meters from a query point
+type NsiDistance struct {
+	Nsi
+	Distance float64 `db:"distance" json:"distance"`
+}
+
+// NsiDistanceSelect adds the geodesic distance in meters to {point} to NsiSelect
+var NsiDistanceSelect = strings.Replace(NsiSelect, "FROM {table_name}",
+	",st_distance(shape::geography,{point}::geography) as distance FROM {table_name}", 1)
+
+// NsiFields are the inventory column names in NsiSelect order
+var NsiFields = dbFields(Nsi{})
+
+func dbFields(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := t.Field(i).Tag.Lookup("db"); ok {
+			fields = append(fields, tag)
+		}
+	}
+	return fields
+}
+
 const NsiStatsSelect = `select
 							count(fd_id) as num_structures,
-							min(yrbuilt) as yrbuilt_min,
-							max(yrbuilt) as yrbuilt_max,
-							avg(num_story) as num_story_mean,
-							sum(resunits) as resunits_sum,
-							sum(empnum) as empnum_sum,
-							sum(teachers) as teachers_sum,
-							sum(students) as students_sum,
-							avg(sqft) as sqft_mean,
-							sum(sqft) as sqft_sum,
-							sum(pop2amu65) as pop2amu65_sum,
-							sum(pop2amo65) as pop2amo65_sum,
-							sum(pop2pmu65) as pop2pmu65_sum,
-							sum(pop2pmo65) as pop2pmo65_sum,
-							sum(val_struct) as val_struct_sum,
-							sum(val_cont) as val_cont_sum,
-							sum(val_vehic) as val_vehic_sum,
-							min(med_yr_blt) as med_yr_blt_min,
-							max(med_yr_blt) as med_yr_blt_max,
-							max(ground_elv)as ground_elv_max,
-							min(ground_elv) as ground_elv_min
-							from nsi `
+							coalesce(min(yrbuilt),0) as yrbuilt_min,
+							coalesce(max(yrbuilt),0) as yrbuilt_max,
+							coalesce(avg(num_story),0) as num_story_mean,
+							coalesce(sum(resunits),0) as resunits_sum,
+							coalesce(sum(empnum),0) as empnum_sum,
+							coalesce(sum(teachers),0) as teachers_sum,
+							coalesce(sum(students),0) as students_sum,
+							coalesce(avg(sqft),0) as sqft_mean,
+							coalesce(sum(sqft),0) as sqft_sum,
+							coalesce(sum(pop2amu65),0) as pop2amu65_sum,
+							coalesce(sum(pop2amo65),0) as pop2amo65_sum,
+							coalesce(sum(pop2pmu65),0) as pop2pmu65_sum,
+							coalesce(sum(pop2pmo65),0) as pop2pmo65_sum,
+							coalesce(sum(val_struct),0) as val_struct_sum,
+							coalesce(sum(val_cont),0) as val_cont_sum,
+							coalesce(sum(val_vehic),0) as val_vehic_sum,
+							coalesce(min(med_yr_blt),0) as med_yr_blt_min,
+							coalesce(max(med_yr_blt),0) as med_yr_blt_max,
+							coalesce(max(ground_elv),0) as ground_elv_max,
+							coalesce(min(ground_elv),0) as ground_elv_min
+							from {table_name} `
 
 type NsiSummary struct {
 	Num_structures int64   `db:"num_structures" json:"num_structures"`
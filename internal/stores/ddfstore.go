@@ -0,0 +1,225 @@
+package stores
+
+import (
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models/types"
+	"github.com/usace/goquery"
+)
+
+func (st DbStore) GetDdfSets() ([]models.DdfSet, error) {
+	sets := []models.DdfSet{}
+	err := (*st.DS).Select().
+		DataSet(&ddfSetTable).
+		StatementKey("selectAll").
+		Dest(&sets).
+		Fetch()
+	return sets, err
+}
+
+func (st DbStore) GetDdfSet(id uuid.UUID) (models.DdfSet, error) {
+	var set models.DdfSet
+	err := (*st.DS).Select().
+		DataSet(&ddfSetTable).
+		StatementKey("selectById").
+		Params(id).
+		Dest(&set).
+		Fetch()
+	return set, err
+}
+
+// GetDdfs returns the functions of a set with their values ordered by depth
+func (st DbStore) GetDdfs(setId uuid.UUID) ([]models.Ddf, error) {
+	ddfs := []models.Ddf{}
+	err := (*st.DS).Select().
+		DataSet(&ddfTable).
+		StatementKey("selectBySet").
+		Params(setId).
+		Dest(&ddfs).
+		Fetch()
+	if err != nil {
+		return nil, err
+	}
+	values := []models.DdfValue{}
+	err = (*st.DS).Select().
+		DataSet(&ddfValueTable).
+		StatementKey("selectBySet").
+		Params(setId).
+		Dest(&values).
+		Fetch()
+	if err != nil {
+		return nil, err
+	}
+	return groupDdfValues(ddfs, values), nil
+}
+
+// GetDatasetDdfs returns the functions assigned to the occupancy types of a
+// dataset.  Occtype is the assigned occupancy type.
+func (st DbStore) GetDatasetDdfs(datasetId uuid.UUID) ([]models.Ddf, error) {
+	ddfs := []models.Ddf{}
+	err := (*st.DS).Select().
+		DataSet(&ddfTable).
+		StatementKey("selectByDataset").
+		Params(datasetId).
+		Dest(&ddfs).
+		Fetch()
+	if err != nil {
+		return nil, err
+	}
+	values := []models.DdfValue{}
+	err = (*st.DS).Select().
+		DataSet(&ddfValueTable).
+		StatementKey("selectByDataset").
+		Params(datasetId).
+		Dest(&values).
+		Fetch()
+	if err != nil {
+		return nil, err
+	}
+	return groupDdfValues(ddfs, values), nil
+}
+
+func groupDdfValues(ddfs []models.Ddf, values []models.DdfValue) []models.Ddf {
+	byDdf := make(map[uuid.UUID][]models.DdfValue)
+	for _, v := range values {
+		byDdf[v.DdfId] = append(byDdf[v.DdfId], v)
+	}
+	for i := range ddfs {
+		ddfs[i].Values = byDdf[ddfs[i].Id]
+	}
+	return ddfs
+}
+
+// AddDdfSet inserts a function set with its functions in a single transaction
+func (st DbStore) AddDdfSet(set *models.DdfSet, ddfs []models.Ddf) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	var id uuid.UUID
+	err = (*st.DS).Select().
+		Tx(&tx).
+		DataSet(&ddfSetTable).
+		StatementKey("insert").
+		Params(set.Name, set.Version, set.Description, set.CreatedBy).
+		Dest(&id).
+		Fetch()
+	if err == nil {
+		err = st.addDdfs(&tx, id, ddfs)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	set.Id = id
+	return nil
+}
+
+func (st DbStore) addDdfs(tx *goquery.Tx, setId uuid.UUID, ddfs []models.Ddf) error {
+	for i := range ddfs {
+		var id uuid.UUID
+		err := (*st.DS).Select().
+			Tx(tx).
+			DataSet(&ddfTable).
+			StatementKey("insert").
+			Params(setId, ddfs[i].Occtype, ddfs[i].Name).
+			Dest(&id).
+			Fetch()
+		if err != nil {
+			return err
+		}
+		ddfs[i].Id = id
+		ddfs[i].SetId = setId
+		for _, v := range ddfs[i].Values {
+			err = (*st.DS).Exec(tx, ddfValueTable.Statements["insert"],
+				id, v.Depth, v.Structure, v.StructureSd, v.Contents, v.ContentsSd)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteDdfSet removes a set, its functions and their assignments
+func (st DbStore) DeleteDdfSet(id uuid.UUID) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	err = (*st.DS).Exec(&tx, ddfSetTable.Statements["delete"], id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st DbStore) GetDdfAssignments(datasetId uuid.UUID) ([]models.DdfAssignment, error) {
+	assignments := []models.DdfAssignment{}
+	err := (*st.DS).Select().
+		DataSet(&ddfAssignmentTable).
+		StatementKey("selectByDataset").
+		Params(datasetId).
+		Dest(&assignments).
+		Fetch()
+	return assignments, err
+}
+
+// AssignDdfSet assigns every function in a set to its occupancy type for a
+// dataset, replacing existing assignments for those occupancy types
+func (st DbStore) AssignDdfSet(datasetId uuid.UUID, setId uuid.UUID) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	err = (*st.DS).Exec(&tx, ddfAssignmentTable.Statements["assignSet"], datasetId, setId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AssignDdf assigns a single function to an occupancy type of a dataset
+func (st DbStore) AssignDdf(datasetId uuid.UUID, occtype string, ddfId uuid.UUID) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	err = (*st.DS).Exec(&tx, ddfAssignmentTable.Statements["assign"], datasetId, occtype, ddfId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st DbStore) DeleteDdfAssignment(datasetId uuid.UUID, occtype string) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	err = (*st.DS).Exec(&tx, ddfAssignmentTable.Statements["delete"], datasetId, occtype)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsAdmin tests if a user has the admin role in any group
+func (st DbStore) IsAdmin(userId string) (bool, error) {
+	var res bool
+	err := (*st.DS).Select().
+		DataSet(&memberTable).
+		StatementKey("isAdmin").
+		Params(userId, types.Admin).
+		Dest(&res).
+		Fetch()
+	return res, err
+}
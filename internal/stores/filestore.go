@@ -0,0 +1,261 @@
+package stores
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	c "github.com/hydrologicengineeringcenter/nsiapi/internal/config"
+)
+
+var ErrFileNotFound = errors.New("file not found in file store")
+var ErrPresignNotSupported = errors.New("file store does not support pre-signed urls")
+var ErrNoBucket = errors.New("AWS_BUCKET is not set for the s3 file store")
+
+// FileStore is the object storage used for export outputs and the
+// pre-built state downloads.  Keys are slash separated paths relative
+// to the root of the store.
+type FileStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Exists(key string) (bool, error)
+	Delete(key string) error
+	PresignedUrl(key string, expiration time.Duration) (string, error)
+}
+
+func NewFileStore(appConfig c.AppConfig) (FileStore, error) {
+	switch appConfig.FileStoreType {
+	case "s3":
+		return NewS3FileStore(appConfig.AwsBucket, appConfig.AwsPrefix)
+	case "local":
+		return NewLocalFileStore(appConfig.FileStorePath)
+	}
+	return nil, fmt.Errorf("invalid file store type: %s", appConfig.FileStoreType)
+}
+
+// PutFile copies a file on local disk into the file store
+func PutFile(fs FileStore, key string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fs.Put(key, f)
+}
+
+////////////////////////////////////////////////////////
+//  S3
+////////////////////////////////////////////////////////
+
+type S3FileStore struct {
+	Bucket string
+	Prefix string
+	sess   *session.Session
+}
+
+// NewS3FileStore creates an s3 file store.  Without a bucket the store is
+// created but every operation fails with ErrNoBucket, so deployments that
+// do not use exports or state downloads need no bucket.
+func NewS3FileStore(bucket string, prefix string) (*S3FileStore, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &S3FileStore{
+		Bucket: bucket,
+		Prefix: prefix,
+		sess:   sess,
+	}, nil
+}
+
+func (fs *S3FileStore) Put(key string, r io.Reader) error {
+	if err := fs.checkBucket(); err != nil {
+		return err
+	}
+	_, err := s3manager.NewUploader(fs.sess).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(fs.Bucket),
+		Key:    aws.String(fs.Prefix + key),
+		Body:   r,
+	})
+	return err
+}
+
+func (fs *S3FileStore) Get(key string) (io.ReadCloser, error) {
+	if err := fs.checkBucket(); err != nil {
+		return nil, err
+	}
+	result, err := s3.New(fs.sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(fs.Bucket),
+		Key:    aws.String(fs.Prefix + key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrFileNotFound
+		}
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func (fs *S3FileStore) Exists(key string) (bool, error) {
+	if err := fs.checkBucket(); err != nil {
+		return false, err
+	}
+	_, err := s3.New(fs.sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(fs.Bucket),
+		Key:    aws.String(fs.Prefix + key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (fs *S3FileStore) Delete(key string) error {
+	if err := fs.checkBucket(); err != nil {
+		return err
+	}
+	_, err := s3.New(fs.sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(fs.Bucket),
+		Key:    aws.String(fs.Prefix + key),
+	})
+	return err
+}
+
+func (fs *S3FileStore) PresignedUrl(key string, expiration time.Duration) (string, error) {
+	if err := fs.checkBucket(); err != nil {
+		return "", err
+	}
+	req, _ := s3.New(fs.sess).GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(fs.Bucket),
+		Key:    aws.String(fs.Prefix + key),
+	})
+	return req.Presign(expiration)
+}
+
+func (fs *S3FileStore) checkBucket() error {
+	if fs.Bucket == "" {
+		return ErrNoBucket
+	}
+	return nil
+}
+
+func isS3NotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////
+//  Local filesystem
+////////////////////////////////////////////////////////
+
+type LocalFileStore struct {
+	Root string
+}
+
+func NewLocalFileStore(root string) (*LocalFileStore, error) {
+	if root == "" {
+		return nil, errors.New("a root path is required for the local file store")
+	}
+	err := os.MkdirAll(root, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFileStore{Root: root}, nil
+}
+
+func (fs *LocalFileStore) path(key string) (string, error) {
+	root := filepath.Clean(fs.Root)
+	path := filepath.Join(root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%s: illegal file store key", key)
+	}
+	return path, nil
+}
+
+func (fs *LocalFileStore) Put(key string, r io.Reader) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	//write to a temp file first so partial files are never served
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (fs *LocalFileStore) Get(key string) (io.ReadCloser, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrFileNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *LocalFileStore) Exists(key string) (bool, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (fs *LocalFileStore) Delete(key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *LocalFileStore) PresignedUrl(key string, expiration time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
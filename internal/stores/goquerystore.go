@@ -90,9 +90,15 @@ func (st DbStore) AddSchema(schema *models.Schema) error {
 }
 
 func (st DbStore) AddDataset(d *models.Dataset) error {
+	return st.addDataset(nil, d)
+}
+
+// addDataset records a dataset, within tx when it is not nil
+func (st DbStore) addDataset(tx *goquery.Tx, d *models.Dataset) error {
 	var ids []uuid.UUID
 	err := (*st.DS).
 		Select().
+		Tx(tx).
 		DataSet(&datasetTable).
 		StatementKey("insertNullShape").
 		Params(
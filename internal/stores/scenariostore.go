@@ -0,0 +1,127 @@
+package stores
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/models"
+)
+
+// TableColumn is an inventory table column and its postgres data type
+type TableColumn struct {
+	Name string `db:"column_name"`
+	Type string `db:"data_type"`
+}
+
+func (st DbStore) GetScenarios() ([]models.Scenario, error) {
+	scenarios := []models.Scenario{}
+	err := (*st.DS).Select().
+		DataSet(&scenarioTable).
+		StatementKey("selectAll").
+		Dest(&scenarios).
+		Fetch()
+	return scenarios, err
+}
+
+func (st DbStore) GetScenario(id uuid.UUID) (models.Scenario, error) {
+	var scenario models.Scenario
+	err := (*st.DS).Select().
+		DataSet(&scenarioTable).
+		StatementKey("selectById").
+		Params(id).
+		Dest(&scenario).
+		Fetch()
+	return scenario, err
+}
+
+func (st DbStore) AddScenario(s *models.Scenario) error {
+	var id uuid.UUID
+	err := (*st.DS).Select().
+		DataSet(&scenarioTable).
+		StatementKey("insert").
+		Params(s.Name, s.Description, s.Definition, s.CreatedBy).
+		Dest(&id).
+		Fetch()
+	if err != nil {
+		return err
+	}
+	s.Id = id
+	return nil
+}
+
+// DeleteScenario removes a scenario.  The lineage of datasets derived from
+// it keeps the scenario definition.
+func (st DbStore) DeleteScenario(id uuid.UUID) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	err = (*st.DS).Exec(&tx, scenarioTable.Statements["delete"], id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTableColumns returns the columns of an inventory table in order
+func (st DbStore) GetTableColumns(tableName string) ([]TableColumn, error) {
+	columns := []TableColumn{}
+	err := (*st.DS).Select().
+		DataSet(&datasetLineageTable).
+		StatementKey("selectColumns").
+		Params(DbSchema, tableName).
+		Dest(&columns).
+		Fetch()
+	return columns, err
+}
+
+// GetDatasetLineage returns the lineage of a derived dataset, or a lineage
+// with a nil id when the dataset was not derived
+func (st DbStore) GetDatasetLineage(datasetId uuid.UUID) (models.DatasetLineage, error) {
+	lineage := []models.DatasetLineage{}
+	err := (*st.DS).Select().
+		DataSet(&datasetLineageTable).
+		StatementKey("selectByDataset").
+		Params(datasetId).
+		Dest(&lineage).
+		Fetch()
+	if err != nil || len(lineage) == 0 {
+		return models.DatasetLineage{}, err
+	}
+	return lineage[0], nil
+}
+
+// AddDerivedDataset creates the inventory table of d with the columns of the
+// source table, fills it with the rows of selectSql and records the dataset
+// and its lineage in a single transaction
+func (st DbStore) AddDerivedDataset(d *models.Dataset, source models.Dataset, selectSql string, params []interface{}, lineage *models.DatasetLineage) error {
+	tx, err := (*st.DS).Transaction()
+	if err != nil {
+		return err
+	}
+	createSql := strings.NewReplacer("{table_name}", d.TableName, "{source_table}", source.TableName).
+		Replace(datasetLineageTable.Statements["createLike"])
+	err = (*st.DS).Exec(&tx, createSql)
+	if err == nil {
+		insertSql := strings.NewReplacer("{table_name}", d.TableName, "{select}", selectSql).
+			Replace(datasetLineageTable.Statements["insertRows"])
+		err = (*st.DS).Exec(&tx, insertSql, params...)
+	}
+	if err == nil {
+		err = st.addDataset(&tx, d)
+	}
+	if err == nil {
+		err = (*st.DS).Exec(&tx, strings.ReplaceAll(datasetTable.Statements["updateBBox"], "{table_name}", d.TableName), d.Id)
+	}
+	if err == nil {
+		lineage.DatasetId = d.Id
+		err = (*st.DS).Exec(&tx, datasetLineageTable.Statements["insert"],
+			lineage.DatasetId, lineage.SourceDatasetId, lineage.ScenarioId, lineage.Definition, lineage.CreatedBy)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -83,6 +83,7 @@ var memberTable = goquery.TableDataSet{
 		"selectId":   `select id from group_member where group_id=$1 and user_id=$2`,
 		"insert":     `insert into group_member (group_id, role, user_id) values ($1, $2, $3) returning id`,
 		"updateRole": `update group_member set role=$2 where id=$1`,
+		"isAdmin":    `select exists (select 1 from group_member where user_id=$1 and role=$2)`,
 	},
 	Fields: models.Group{},
 }
@@ -119,3 +120,82 @@ var schemaTable = goquery.TableDataSet{
 	},
 	Fields: models.Schema{},
 }
+
+var ddfSetTable = goquery.TableDataSet{
+	Name:   "ddf_set",
+	Schema: DbSchema,
+	Statements: map[string]string{
+		"selectAll":  `select * from ddf_set order by name, version`,
+		"selectById": `select * from ddf_set where id=$1`,
+		"insert":     `insert into ddf_set (name, version, description, created_by) values ($1, $2, $3, $4) returning id`,
+		"delete":     `delete from ddf_set where id=$1`,
+	},
+	Fields: models.DdfSet{},
+}
+
+var ddfTable = goquery.TableDataSet{
+	Name:   "ddf",
+	Schema: DbSchema,
+	Statements: map[string]string{
+		"selectBySet": `select * from ddf where ddf_set_id=$1 order by occtype`,
+		"selectByDataset": `select d.id, d.ddf_set_id, a.occtype, d.name from ddf d
+            join ddf_assignment a on a.ddf_id=d.id where a.dataset_id=$1 order by a.occtype`,
+		"insert": `insert into ddf (ddf_set_id, occtype, name) values ($1, $2, $3) returning id`,
+	},
+	Fields: models.Ddf{},
+}
+
+var ddfValueTable = goquery.TableDataSet{
+	Name:   "ddf_value",
+	Schema: DbSchema,
+	Statements: map[string]string{
+		"selectBySet": `select v.* from ddf_value v join ddf d on d.id=v.ddf_id where d.ddf_set_id=$1 order by v.ddf_id, v.depth`,
+		"selectByDataset": `select v.* from ddf_value v join ddf_assignment a on a.ddf_id=v.ddf_id
+            where a.dataset_id=$1 order by v.ddf_id, v.depth`,
+		"insert": `insert into ddf_value (ddf_id, depth, structure, structure_sd, contents, contents_sd) values ($1, $2, $3, $4, $5, $6)`,
+	},
+	Fields: models.DdfValue{},
+}
+
+var ddfAssignmentTable = goquery.TableDataSet{
+	Name:   "ddf_assignment",
+	Schema: DbSchema,
+	Statements: map[string]string{
+		"selectByDataset": `select a.id, a.dataset_id, a.occtype, a.ddf_id, d.ddf_set_id, d.name from ddf_assignment a
+            join ddf d on d.id=a.ddf_id where a.dataset_id=$1 order by a.occtype`,
+		"assignSet": `insert into ddf_assignment (dataset_id, occtype, ddf_id)
+            select $1, occtype, id from ddf where ddf_set_id=$2
+            on conflict (dataset_id, occtype) do update set ddf_id=excluded.ddf_id`,
+		"assign": `insert into ddf_assignment (dataset_id, occtype, ddf_id) values ($1, $2, $3)
+            on conflict (dataset_id, occtype) do update set ddf_id=excluded.ddf_id`,
+		"delete": `delete from ddf_assignment where dataset_id=$1 and occtype=$2`,
+	},
+	Fields: models.DdfAssignment{},
+}
+
+var scenarioTable = goquery.TableDataSet{
+	Name:   "scenario",
+	Schema: DbSchema,
+	Statements: map[string]string{
+		"selectAll":  `select * from scenario order by name`,
+		"selectById": `select * from scenario where id=$1`,
+		"insert":     `insert into scenario (name, description, definition, created_by) values ($1, $2, $3, $4) returning id`,
+		"delete":     `delete from scenario where id=$1`,
+	},
+	Fields: models.Scenario{},
+}
+
+var datasetLineageTable = goquery.TableDataSet{
+	Name:   "dataset_lineage",
+	Schema: DbSchema,
+	Statements: map[string]string{
+		"selectByDataset": `select * from dataset_lineage where dataset_id=$1`,
+		"insert": `insert into dataset_lineage (dataset_id, source_dataset_id, scenario_id, definition, created_by)
+            values ($1, $2, $3, $4, $5)`,
+		"selectColumns": `select column_name, data_type from information_schema.columns
+            where table_schema=$1 and table_name=$2 order by ordinal_position`,
+		"createLike": fmt.Sprintf(`create table %s.{table_name} (like %s.{source_table} including all)`, DbSchema, DbSchema),
+		"insertRows": fmt.Sprintf(`insert into %s.{table_name} {select}`, DbSchema),
+	},
+	Fields: models.DatasetLineage{},
+}
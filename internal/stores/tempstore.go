@@ -1,17 +1,64 @@
 package stores
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
 	c "github.com/hydrologicengineeringcenter/nsiapi/internal/config"
 	_ "github.com/jackc/pgx/stdlib"
 )
 
+var jobBucket = []byte("JOBS")
+var legacyStatusBucket = []byte("STATUS")
+var webhookBucket = []byte("WEBHOOKS")
+var exportKeyBucket = []byte("EXPORTKEYS")
+
 type TempStore struct {
 	store *bolt.DB
 }
 
+// Job is the status record for an async export
+type Job struct {
+	Id           string          `json:"id"`
+	Status       string          `json:"status"`
+	Format       string          `json:"format,omitempty"`
+	Aoi          json.RawMessage `json:"aoi,omitempty"`
+	FeatureCount int             `json:"feature_count"`
+	Location     string          `json:"location,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Summary      json.RawMessage `json:"summary,omitempty"`
+	Callbacks    []Callback      `json:"callbacks,omitempty"`
+	Deliveries   []Delivery      `json:"deliveries,omitempty"`
+	Created      time.Time       `json:"created"`
+	Updated      time.Time       `json:"updated"`
+	Completed    *time.Time      `json:"completed,omitempty"`
+}
+
+// Callback is a url notified when a job finishes.  Owner is the user who
+// requested it, or empty for anonymous requests.
+type Callback struct {
+	Url   string `json:"url"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// Delivery records a single webhook delivery attempt for a job
+type Delivery struct {
+	Url        string    `json:"url"`
+	Owner      string    `json:"owner,omitempty"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	Time       time.Time `json:"time"`
+}
+
+type Webhook struct {
+	Url     string    `json:"url"`
+	Created time.Time `json:"created"`
+}
+
 func InitTempStore(config c.AppConfig) (*TempStore, error) {
 	store := TempStore{}
 	err := store.Open(config)
@@ -24,11 +71,13 @@ func (ts *TempStore) Open(appConfig c.AppConfig) error {
 		return err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte("STATUS"))
-		if err != nil {
-			return fmt.Errorf("could not create root bucket: %v", err)
+		for _, bucket := range [][]byte{jobBucket, webhookBucket, exportKeyBucket} {
+			_, err = tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return fmt.Errorf("could not create %s bucket: %v", bucket, err)
+			}
 		}
-		return nil
+		return migrateStatuses(tx)
 	})
 	if err != nil {
 		return err
@@ -37,6 +86,28 @@ func (ts *TempStore) Open(appConfig c.AppConfig) error {
 	return nil
 }
 
+// migrateStatuses moves the plain statuses recorded before jobs were stored
+// into the job bucket, so exports started by an earlier version can still be
+// checked and downloaded
+func migrateStatuses(tx *bolt.Tx) error {
+	statuses := tx.Bucket(legacyStatusBucket)
+	if statuses == nil {
+		return nil
+	}
+	err := statuses.ForEach(func(k []byte, v []byte) error {
+		if tx.Bucket(jobBucket).Get(k) != nil {
+			return nil
+		}
+		return updateJob(tx, string(k), func(job *Job) {
+			job.Status = string(v)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("could not migrate %s bucket: %v", legacyStatusBucket, err)
+	}
+	return tx.DeleteBucket(legacyStatusBucket)
+}
+
 func (ts *TempStore) Close() error {
 	err := ts.store.Close()
 	if err != nil {
@@ -46,25 +117,148 @@ func (ts *TempStore) Close() error {
 }
 
 func (ts *TempStore) PutStatus(guid string, status string) error {
+	return ts.UpdateJob(guid, func(job *Job) {
+		job.Status = status
+	})
+}
+
+func (ts *TempStore) GetStatus(guid string) (string, error) {
+	job, err := ts.GetJob(guid)
+	if err != nil {
+		return "", err
+	}
+	if job == nil {
+		return "", nil
+	}
+	return job.Status, nil
+}
+
+// GetJob returns nil if there is no job for the guid
+func (ts *TempStore) GetJob(guid string) (*Job, error) {
+	var job *Job
+	err := ts.store.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobBucket).Get([]byte(guid))
+		if data == nil {
+			return nil
+		}
+		job = &Job{}
+		return json.Unmarshal(data, job)
+	})
+	return job, err
+}
+
+// UpdateJob applies update to the stored job, creating the job if it does not exist
+func (ts *TempStore) UpdateJob(guid string, update func(job *Job)) error {
 	err := ts.store.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte("STATUS")).Put([]byte(guid), []byte(status))
+		return updateJob(tx, guid, update)
+	})
+	return err
+}
+
+// updateJob records when a job is first completed.  Updated also changes
+// with later records such as webhook deliveries.
+func updateJob(tx *bolt.Tx, guid string, update func(job *Job)) error {
+	bucket := tx.Bucket(jobBucket)
+	job := Job{Id: guid, Created: time.Now()}
+	if data := bucket.Get([]byte(guid)); data != nil {
+		err := json.Unmarshal(data, &job)
 		if err != nil {
-			return fmt.Errorf("could not update status for %s: %v", guid, err)
+			return err
 		}
-		return nil
+	}
+	update(&job)
+	job.Updated = time.Now()
+	if job.Status == "Completed" && job.Completed == nil {
+		job.Completed = &job.Updated
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	err = bucket.Put([]byte(guid), data)
+	if err != nil {
+		return fmt.Errorf("could not update job %s: %v", guid, err)
+	}
+	return nil
+}
+
+// CompletedBefore returns the completed jobs that finished before t.  Jobs
+// recorded without a completion time use their last update.
+func (ts *TempStore) CompletedBefore(t time.Time) ([]Job, error) {
+	jobs := []Job{}
+	err := ts.store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobBucket).ForEach(func(k []byte, v []byte) error {
+			var job Job
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			completed := job.Updated
+			if job.Completed != nil {
+				completed = *job.Completed
+			}
+			if job.Status == "Completed" && completed.Before(t) {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+func (ts *TempStore) GetWebhooks(userId string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := ts.store.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(webhookBucket).Get([]byte(userId))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &webhooks)
+	})
+	return webhooks, err
+}
+
+func (ts *TempStore) PutWebhooks(userId string, webhooks []Webhook) error {
+	err := ts.store.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhookBucket)
+		if len(webhooks) == 0 {
+			return bucket.Delete([]byte(userId))
+		}
+		data, err := json.Marshal(webhooks)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(userId), data)
 	})
 	return err
 }
 
-func (ts *TempStore) GetStatus(guid string) (string, error) {
-	var status string
+// GetExportJob returns the guid of the last job started for a normalized export key
+func (ts *TempStore) GetExportJob(key string) (string, error) {
+	var guid string
 	err := ts.store.View(func(tx *bolt.Tx) error {
-		status = string(tx.Bucket([]byte("STATUS")).Get([]byte(guid)))
+		guid = string(tx.Bucket(exportKeyBucket).Get([]byte(key)))
 		return nil
 	})
-	if err != nil {
-		return "", err
-	} else {
-		return status, nil
-	}
+	return guid, err
+}
+
+// SwapExportJob points an export key at a new job and creates the job with
+// initialize, provided the key still points at the old guid.  It is not ok
+// when another request changed the key first.
+func (ts *TempStore) SwapExportJob(key string, old string, guid string, initialize func(job *Job)) (bool, error) {
+	swapped := false
+	err := ts.store.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(exportKeyBucket)
+		if string(bucket.Get([]byte(key))) != old {
+			return nil
+		}
+		err := bucket.Put([]byte(key), []byte(guid))
+		if err != nil {
+			return err
+		}
+		swapped = true
+		return updateJob(tx, guid, initialize)
+	})
+	return swapped, err
 }
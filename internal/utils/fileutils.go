@@ -2,6 +2,9 @@ package utils
 
 import (
 	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
@@ -17,29 +20,235 @@ const (
 	Shapefile GisFileType = iota
 	Geopackage
 	FileGeodatabase
+	GeoJSON
+	KML
+	CSV
 )
 
+// sidecar files that are part of a shapefile or other dataset rather than
+// datasets of their own
+var sidecarExtensions = map[string]bool{
+	".shx": true, ".dbf": true, ".prj": true, ".cpg": true, ".sbn": true,
+	".sbx": true, ".qix": true, ".fix": true, ".xml": true, ".qpj": true,
+}
+
+var csvWktColumns = []string{"wkt", "geom", "geometry", "the_geom", "shape"}
+var csvXColumns = []string{"lon", "long", "longitude", "lng", "x"}
+var csvYColumns = []string{"lat", "latitude", "y"}
+
+// GetGdalDriverName returns the ogr driver used to open a gis file type.  Csv
+// files are opened through a vrt describing their geometry columns.
 func GetGdalDriverName(gisFileType GisFileType) (string, error) {
 	switch gisFileType {
 	case Shapefile:
 		return "ESRI Shapefile", nil
 	case Geopackage:
 		return "GPKG", nil
+	case FileGeodatabase:
+		return "OpenFileGDB", nil
+	case GeoJSON:
+		return "GeoJSON", nil
+	case KML:
+		return "KML", nil
+	case CSV:
+		return "OGR_VRT", nil
 	}
 	return "", errors.New("Invalid Gis File Type")
 }
 
+// GetGisFileType finds the single dataset in a list of uploaded files.  Files
+// are recognized by extension, or by content when the extension is unknown.
+// File geodatabases are returned as their .gdb folder.
 func GetGisFileType(files []string) (GisFileType, string, error) {
+	var types []GisFileType
+	var names []string
+	gdbs := map[string]bool{}
 	for _, f := range files {
-		ext := filepath.Ext(s.ToLower(f))
-		fmt.Printf("%s >>> %s\n", f, ext)
-		if ext == ".shp" {
-			return Shapefile, f, nil
-		} else if ext == ".gpkg" {
-			return Geopackage, f, nil
+		if s.Contains(f, "__MACOSX") || s.HasPrefix(filepath.Base(f), "._") {
+			continue
+		}
+		if gdb := gdbDir(f); gdb != "" {
+			if !gdbs[gdb] {
+				gdbs[gdb] = true
+				types = append(types, FileGeodatabase)
+				names = append(names, gdb)
+			}
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if gisFileType, ok := detectGisFileType(f); ok {
+			types = append(types, gisFileType)
+			names = append(names, f)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return -1, "", errors.New("Invalid geospatial upload. Supported formats are zipped shapefiles and file geodatabases, geopackage, geojson, kml, kmz and csv.")
+	case 1:
+		return types[0], names[0], nil
+	}
+	baseNames := make([]string, len(names))
+	for i, name := range names {
+		baseNames[i] = filepath.Base(name)
+	}
+	return -1, "", fmt.Errorf("Upload contains %d datasets (%s). Upload a single dataset.", len(names), s.Join(baseNames, ", "))
+}
+
+// gdbDir returns the file geodatabase folder containing f, if any
+func gdbDir(f string) string {
+	parts := s.Split(filepath.ToSlash(f), "/")
+	for i, part := range parts {
+		if s.HasSuffix(s.ToLower(part), ".gdb") {
+			return filepath.FromSlash(s.Join(parts[:i+1], "/"))
+		}
+	}
+	if filepath.Ext(s.ToLower(f)) == ".gdbtable" {
+		return filepath.Dir(f)
+	}
+	return ""
+}
+
+func detectGisFileType(f string) (GisFileType, bool) {
+	ext := filepath.Ext(s.ToLower(f))
+	if sidecarExtensions[ext] {
+		return -1, false
+	}
+	switch ext {
+	case ".shp":
+		return Shapefile, true
+	case ".gpkg":
+		return Geopackage, true
+	case ".geojson":
+		return GeoJSON, true
+	case ".kml":
+		return KML, true
+	case ".csv":
+		return CSV, true
+	}
+	header, err := readHeader(f, 4096)
+	if err != nil {
+		return -1, false
+	}
+	text := s.TrimLeft(string(header), "\ufeff \t\r\n")
+	switch {
+	case bytes.HasPrefix(header, []byte{0x00, 0x00, 0x27, 0x0a}):
+		return Shapefile, true
+	case bytes.HasPrefix(header, []byte("SQLite format 3\x00")):
+		return Geopackage, true
+	case s.HasPrefix(text, "{") && s.Contains(text, `"type"`):
+		return GeoJSON, true
+	case s.HasPrefix(text, "<") && s.Contains(text, "<kml"):
+		return KML, true
+	}
+	if columns, err := csvHeader(f); err == nil && len(columns) > 1 {
+		if _, _, _, err := csvGeometryColumns(columns); err == nil {
+			return CSV, true
 		}
 	}
-	return -1, "", errors.New("Invalid geospatial upload.")
+	return -1, false
+}
+
+func readHeader(f string, size int) ([]byte, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header := make([]byte, size)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// IsZip reports whether the file is a zip archive, which includes kmz files
+func IsZip(f string) bool {
+	header, err := readHeader(f, 4)
+	return err == nil && bytes.Equal(header, []byte("PK\x03\x04"))
+}
+
+func csvHeader(f string) ([]string, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return csv.NewReader(file).Read()
+}
+
+// csvGeometryColumns returns either the wkt column or the x and y columns of a csv header
+func csvGeometryColumns(columns []string) (string, string, string, error) {
+	find := func(names []string) string {
+		for _, name := range names {
+			for _, column := range columns {
+				if s.ToLower(s.TrimSpace(s.TrimPrefix(column, "\ufeff"))) == name {
+					return column
+				}
+			}
+		}
+		return ""
+	}
+	if wkt := find(csvWktColumns); wkt != "" {
+		return wkt, "", "", nil
+	}
+	x, y := find(csvXColumns), find(csvYColumns)
+	if x != "" && y != "" {
+		return "", x, y, nil
+	}
+	return "", "", "", errors.New("CSV uploads require a WKT column or longitude and latitude columns")
+}
+
+// WriteCsvVrt writes a vrt next to the csv file describing its geometry and
+// returns the path of the vrt.  Longitude and latitude columns are assumed to
+// be EPSG:4326, wkt columns take the crs given with the upload.
+func WriteCsvVrt(csvFile string) (string, error) {
+	columns, err := csvHeader(csvFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read CSV header: %s", err)
+	}
+	wkt, x, y, err := csvGeometryColumns(columns)
+	if err != nil {
+		return "", err
+	}
+	layerName := s.TrimSuffix(filepath.Base(csvFile), filepath.Ext(csvFile))
+	var geometry string
+	if wkt != "" {
+		geometry = fmt.Sprintf(`<GeometryType>wkbUnknown</GeometryType>
+    <GeometryField encoding="WKT" field="%s"/>`, xmlEscape(wkt))
+	} else {
+		geometry = fmt.Sprintf(`<GeometryType>wkbPoint</GeometryType>
+    <LayerSRS>EPSG:4326</LayerSRS>
+    <GeometryField encoding="PointFromColumns" x="%s" y="%s"/>`, xmlEscape(x), xmlEscape(y))
+	}
+	//the csv driver only recognizes other extensions with the CSV: prefix
+	src := csvFile
+	if s.ToLower(filepath.Ext(csvFile)) != ".csv" {
+		src = "CSV:" + csvFile
+	}
+	vrt := fmt.Sprintf(`<OGRVRTDataSource>
+  <OGRVRTLayer name="%s">
+    <SrcDataSource relativeToVRT="0">%s</SrcDataSource>
+    <SrcLayer>%s</SrcLayer>
+    %s
+  </OGRVRTLayer>
+</OGRVRTDataSource>
+`, xmlEscape(layerName), xmlEscape(src), xmlEscape(layerName), geometry)
+	vrtFile := s.TrimSuffix(csvFile, filepath.Ext(csvFile)) + ".vrt"
+	err = os.WriteFile(vrtFile, []byte(vrt), 0644)
+	if err != nil {
+		return "", err
+	}
+	return vrtFile, nil
+}
+
+func xmlEscape(text string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
 }
 
 func CopyPostFileToTemp(tempstorage string, tempname string, file *multipart.FileHeader) (string, error) {
@@ -125,3 +334,53 @@ func Unzip(src string, dest string) ([]string, error) {
 	}
 	return filenames, nil
 }
+
+// ZipSize returns the total uncompressed size of the files in a zip archive
+func ZipSize(src string) (int64, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	var size int64
+	for _, f := range r.File {
+		size += int64(f.UncompressedSize64)
+	}
+	return size, nil
+}
+
+// ZipDir writes every file in the src directory to a new zip archive at dest
+func ZipDir(src string, dest string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := zip.NewWriter(out)
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		err = func() error {
+			in, err := os.Open(filepath.Join(src, entry.Name()))
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			f, err := w.Create(entry.Name())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, in)
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,199 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+)
+
+const SignatureHeader = "X-NSI-Signature"
+
+var ErrDisabled = errors.New("webhooks are disabled because WEBHOOK_SECRET is not set")
+
+// sharedAddressSpace is the carrier grade NAT range of RFC 6598, which is
+// not reachable from the internet
+var sharedAddressSpace = net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type Payload struct {
+	JobId        string    `json:"job_id"`
+	State        string    `json:"state"`
+	FeatureCount int       `json:"feature_count"`
+	Location     string    `json:"location,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// Sender posts signed job payloads to callback urls, retrying failed
+// deliveries with an exponential backoff
+type Sender struct {
+	Secret      string
+	MaxAttempts int
+	Backoff     time.Duration
+	Client      *http.Client
+}
+
+// NewSender returns a sender whose client only connects to public addresses,
+// so callbacks, including redirects and hosts that later resolve
+// differently, cannot reach the internal network of the server
+func NewSender(secret string, maxAttempts int, backoff time.Duration) *Sender {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkIP(net.ParseIP(host))
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &Sender{
+		Secret:      secret,
+		MaxAttempts: maxAttempts,
+		Backoff:     backoff,
+		Client:      &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// Enabled tests if payloads can be signed
+func (s *Sender) Enabled() bool {
+	return s.Secret != ""
+}
+
+// ValidateUrl checks that a callback is an http or https url of a host that
+// resolves to public addresses only
+func ValidateUrl(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("callback must be an absolute http or https url")
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("unable to resolve callback host %s", u.Hostname())
+	}
+	for _, ip := range ips {
+		err = checkIP(ip)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIP rejects loopback, private, link local (including cloud metadata
+// services), multicast and unspecified addresses
+func checkIP(ip net.IP) error {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("callback address %s is not a public address", ip)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NotifyJob delivers the current state of a job to each of its callbacks.
+// Every attempt is recorded on the job.
+func (s *Sender) NotifyJob(tempStore *stores.TempStore, guid string) {
+	job, err := tempStore.GetJob(guid)
+	if err != nil || job == nil {
+		log.Printf("Unable to load job %s for webhook delivery: %v\n", guid, err)
+		return
+	}
+	s.NotifyCallbacks(tempStore, job, job.Callbacks)
+}
+
+func (s *Sender) NotifyCallbacks(tempStore *stores.TempStore, job *stores.Job, callbacks []stores.Callback) {
+	guid := job.Id
+	payload := Payload{
+		JobId:        job.Id,
+		State:        job.Status,
+		FeatureCount: job.FeatureCount,
+		Location:     job.Location,
+		Timestamp:    time.Now(),
+	}
+	for _, callback := range callbacks {
+		s.Deliver(callback, payload, func(d stores.Delivery) {
+			err := tempStore.UpdateJob(guid, func(job *stores.Job) {
+				job.Deliveries = append(job.Deliveries, d)
+			})
+			if err != nil {
+				log.Printf("Unable to record webhook delivery for %s: %s\n", guid, err)
+			}
+		})
+	}
+}
+
+func (s *Sender) Deliver(callback stores.Callback, payload Payload, record func(stores.Delivery)) bool {
+	body, err := json.Marshal(payload)
+	if err == nil && !s.Enabled() {
+		err = ErrDisabled
+	}
+	if err != nil {
+		record(stores.Delivery{Url: callback.Url, Owner: callback.Owner, Attempt: 1, Error: err.Error(), Time: time.Now()})
+		return false
+	}
+	signature := "sha256=" + Sign(s.Secret, body)
+	wait := s.Backoff
+	for attempt := 1; attempt <= s.MaxAttempts; attempt++ {
+		d := stores.Delivery{Url: callback.Url, Owner: callback.Owner, Attempt: attempt, Time: time.Now()}
+		statusCode, err := s.post(callback.Url, body, signature)
+		d.StatusCode = statusCode
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Delivered = true
+		}
+		record(d)
+		if d.Delivered {
+			return true
+		}
+		if attempt < s.MaxAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	log.Printf("Giving up on webhook delivery to %s for job %s\n", callback.Url, payload.JobId)
+	return false
+}
+
+func (s *Sender) post(callback string, body []byte, signature string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("callback responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
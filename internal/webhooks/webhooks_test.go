@@ -0,0 +1,70 @@
+package webhooks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckIP(t *testing.T) {
+	tests := []struct {
+		ip string
+		ok bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if err := checkIP(net.ParseIP(tt.ip)); (err == nil) != tt.ok {
+				t.Errorf("checkIP(%s) error = %v, want ok %v", tt.ip, err, tt.ok)
+			}
+		})
+	}
+	if checkIP(nil) == nil {
+		t.Error("checkIP(nil) is ok")
+	}
+}
+
+func TestValidateUrl(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://8.8.8.8/hook", true},
+		{"http://8.8.8.8:8080/hook?job=1", true},
+		{"https://[2001:4860:4860::8888]/hook", true},
+		{"ftp://8.8.8.8/hook", false},
+		{"/hook", false},
+		{"https:///hook", false},
+		{"://bad", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://localhost/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::1]:9000/hook", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://0x7f000001/hook", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := ValidateUrl(tt.url); (err == nil) != tt.ok {
+				t.Errorf("ValidateUrl(%s) error = %v, want ok %v", tt.url, err, tt.ok)
+			}
+		})
+	}
+}
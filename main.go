@@ -2,10 +2,13 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/config"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/gis"
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/handlers"
 	"github.com/hydrologicengineeringcenter/nsiapi/internal/stores"
+	"github.com/hydrologicengineeringcenter/nsiapi/internal/webhooks"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 )
@@ -27,32 +30,80 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error initializing local temparary data store: %s. Shutting down.", err)
 	}
+	fileStore, err := stores.NewFileStore(config)
+	if err != nil {
+		log.Fatalf("Error initializing %s file store: %s. Shutting down.", config.FileStoreType, err)
+	}
+	if config.FileStoreType == "s3" && config.AwsBucket == "" {
+		log.Println("AWS_BUCKET is not set. Exports and state downloads will fail until it is.")
+	}
+
+	gis.RegisterOptionalFormats()
+	gis.AddDatumGrids(config.VerticalDatumGrids)
+	gis.CheckDatumGrids()
+	if config.WebhookSecret == "" {
+		log.Println("WEBHOOK_SECRET is not set. Webhooks and export callbacks are disabled.")
+	}
 
 	e := echo.New()
 	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
 		StackSize: 1 << 10, // 1 KB
 	}))
 	e.Use(middleware.Logger())
+	if config.AuthSecret != "" {
+		e.Use(handlers.Authenticate(config.AuthSecret))
+	} else {
+		log.Println("AUTH_SECRET is not set. Requests that need a user will be refused.")
+	}
 
 	api := handlers.ApiHandler{
 		TempStore: tempStore,
 		DataStore: dataStore,
+		FileStore: fileStore,
+		Webhooks:  webhooks.NewSender(config.WebhookSecret, config.WebhookMaxAttempts, config.WebhookBackoff),
 		Config:    config,
 		GQStore:   gqStore,
 	}
+	go api.RemoveExpiredExports(time.Hour)
 
 	e.GET(apiprefix+"/home", api.ApiHome)
 	e.GET(apiprefix+"/structures", api.GetStructures)
+	e.GET(apiprefix+"/structures/near", api.GetNearStructures)
 	e.GET(apiprefix+"/structure/:structureId", api.GetStructure)
 	e.POST(apiprefix+"/structures", api.StructuresFromUpload)
+	e.POST(apiprefix+"/structures/lookup", api.LookupStructures)
+	e.POST(apiprefix+"/structures/hazards", api.SampleHazards)
+	e.POST(apiprefix+"/structures/overlay", api.OverlayStructures)
+	e.POST(apiprefix+"/structures/distance", api.StructureDistances)
 	e.GET(apiprefix+"/hexbins/:dataset", api.GetHexbins)
 	e.GET(apiprefix+"/export", api.CreateExport)
 	e.GET(apiprefix+"/export/:uuid", api.GetExport)
 	e.GET(apiprefix+"/export/:uuid/status", api.GetStatus)
 	e.POST(apiprefix+"/export", api.ExportFromUpload)
+	e.POST(apiprefix+"/consequences", api.Consequences)
+	e.POST(apiprefix+"/realizations", api.GenerateRealizations)
+	e.GET(apiprefix+"/populationatrisk", api.GetPopulationAtRisk)
+	e.POST(apiprefix+"/populationatrisk", api.PopulationAtRiskFromUpload)
+	e.GET(apiprefix+"/ddf/sets", api.GetDdfSets)
+	e.GET(apiprefix+"/ddf/sets/:id", api.GetDdfSet)
+	e.POST(apiprefix+"/ddf/sets", api.AddDdfSet)
+	e.PUT(apiprefix+"/ddf/sets/:id", api.UpdateDdfSet)
+	e.DELETE(apiprefix+"/ddf/sets/:id", api.DeleteDdfSet)
+	e.POST(apiprefix+"/ddf/sets/:id/assign", api.AssignDdfSet)
+	e.GET(apiprefix+"/ddf/assignments", api.GetDdfAssignments)
+	e.DELETE(apiprefix+"/ddf/assignments", api.DeleteDdfAssignment)
+	e.GET(apiprefix+"/scenarios", api.GetScenarios)
+	e.GET(apiprefix+"/scenarios/:id", api.GetScenario)
+	e.POST(apiprefix+"/scenarios", api.AddScenario)
+	e.DELETE(apiprefix+"/scenarios/:id", api.DeleteScenario)
+	e.POST(apiprefix+"/scenarios/:id/apply", api.ApplyScenario)
+	e.GET(apiprefix+"/lineage", api.GetDatasetLineage)
 	e.GET(apiprefix+"/stats", api.GetStats)
 	e.POST(apiprefix+"/stats", api.StatsFromUpload)
 	e.GET(apiprefix+"/export/state/:file", api.DownloadFileDataset)
+	e.GET(apiprefix+"/webhooks", api.GetWebhooks)
+	e.POST(apiprefix+"/webhooks", api.AddWebhook)
+	e.DELETE(apiprefix+"/webhooks", api.DeleteWebhook)
 
 	e.Debug = config.Debug
 
@@ -1,3 +1,9 @@
+drop table dataset_lineage;
+drop table scenario;
+drop table ddf_assignment;
+drop table ddf_value;
+drop table ddf;
+drop table ddf_set;
 drop table dataset;
 drop table access;
 drop table quality;
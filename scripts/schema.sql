@@ -60,3 +60,85 @@ create table dataset (
         foreign key(quality_id)
             references quality(id)
 );
+
+create table ddf_set (
+    id uuid not null default gen_random_uuid() primary key,
+    name text not null,
+    version text not null,
+    description text,
+    date_created date not null default current_date,
+    created_by text not null,
+    unique (name, version)
+);
+
+create table ddf (
+    id uuid not null default gen_random_uuid() primary key,
+    ddf_set_id uuid not null,
+    occtype text not null,
+    name text not null,
+    unique (ddf_set_id, occtype),
+    constraint fk_ddf_ddf_set
+        foreign key(ddf_set_id)
+            references ddf_set(id)
+            on delete cascade
+);
+
+create table ddf_value (
+    id uuid not null default gen_random_uuid() primary key,
+    ddf_id uuid not null,
+    depth double precision not null,
+    structure double precision not null,
+    structure_sd double precision not null default 0,
+    contents double precision not null,
+    contents_sd double precision not null default 0,
+    constraint fk_ddf_value_ddf
+        foreign key(ddf_id)
+            references ddf(id)
+            on delete cascade
+);
+
+create table ddf_assignment (
+    id uuid not null default gen_random_uuid() primary key,
+    dataset_id uuid not null,
+    occtype text not null,
+    ddf_id uuid not null,
+    unique (dataset_id, occtype),
+    constraint fk_ddf_assignment_dataset
+        foreign key(dataset_id)
+            references dataset(id)
+            on delete cascade,
+    constraint fk_ddf_assignment_ddf
+        foreign key(ddf_id)
+            references ddf(id)
+            on delete cascade
+);
+
+create table scenario (
+    id uuid not null default gen_random_uuid() primary key,
+    name text not null unique,
+    description text,
+    definition jsonb not null,
+    date_created date not null default current_date,
+    created_by text not null
+);
+
+create table dataset_lineage (
+    id uuid not null default gen_random_uuid() primary key,
+    dataset_id uuid not null unique,
+    source_dataset_id uuid not null,
+    scenario_id uuid,
+    definition jsonb not null,
+    date_created date not null default current_date,
+    created_by text not null,
+    constraint fk_dataset_lineage_dataset
+        foreign key(dataset_id)
+            references dataset(id)
+            on delete cascade,
+    constraint fk_dataset_lineage_source
+        foreign key(source_dataset_id)
+            references dataset(id),
+    constraint fk_dataset_lineage_scenario
+        foreign key(scenario_id)
+            references scenario(id)
+            on delete set null
+);